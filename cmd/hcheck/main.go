@@ -0,0 +1,122 @@
+// Copyright 2023. Silvano DAL ZILIO (LAAS-CNRS). All rights reserved. Use of
+// this source code is governed by the GNU Affero license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/dalzilio/hue/pkg/hlnet"
+	"github.com/dalzilio/hue/pkg/pnml"
+	flag "github.com/spf13/pflag"
+)
+
+// builddate stores the compilation date for the executable, in %Y%m%d format.
+// Set in the Makefile with the result of:
+//
+//	date -u +%d/%m/%Y
+var builddate string = "2020/01/01"
+
+// gitversion stores the current git version. Set in the makefile with the result
+// of:
+//
+//	git describe --tags --dirty --always
+var gitversion string = "v0"
+
+// result is the diagnostic for one model. Error is set when we cannot load the
+// model, in which case there is no report.
+type result struct {
+	Model string `json:"model"`
+	Error string `json:"error,omitempty"`
+	*hlnet.Report
+}
+
+func main() {
+	var flaghelp = flag.BoolP("help", "h", false, "print this message")
+	var flagversion = flag.Bool("version", false, "print version number and generation date then quit")
+
+	var flagjson = flag.Bool("json", false, "print the results in JSON")
+	var count = flag.IntP("count", "c", 1000, "number of transitions fired at random to look for forbidden transitions")
+	var seed = flag.Int64P("seed", "s", 0, "seed for the random walk")
+
+	flag.CommandLine.SortFlags = false
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "hcheck version %s -- %s -- LAAS/CNRS\n", gitversion, builddate)
+		fmt.Fprintf(os.Stderr, "Usage of %s: [options] model...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "   where model is a PNML file or a folder containing model.pnml\n")
+		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nfiles:\n")
+		fmt.Fprintf(os.Stderr, "   outfile: output is always on stdout\n")
+		fmt.Fprintf(os.Stderr, "   errorfile: error are always printed on stderr\n")
+	}
+
+	flag.Parse()
+
+	switch {
+	case *flagversion:
+		fmt.Printf("hcheck version %s -- %s -- LAAS/CNRS\n", gitversion, builddate)
+		os.Exit(1)
+	case *flaghelp:
+		flag.Usage()
+		os.Exit(0)
+	case len(flag.Args()) == 0:
+		fmt.Println("bad command line, missing PNML file")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	results := []result{}
+	for _, model := range flag.Args() {
+		res := result{Model: model}
+		hl, err := load(model)
+		if err != nil {
+			res.Error = err.Error()
+			if !*flagjson {
+				log.Printf("Error with model %s: %s\n", model, err)
+			}
+		} else {
+			res.Report = hlnet.Diagnose(hl, *count, *seed)
+			if !*flagjson {
+				fmt.Printf("# %s\n%s", model, res.Report)
+			}
+		}
+		results = append(results, res)
+	}
+
+	if *flagjson {
+		b, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			log.Fatal("Error writing JSON: ", err)
+		}
+		fmt.Println(string(b))
+	}
+}
+
+// load returns the hlnet for a model, given as a PNML file or as a folder
+// containing a file model.pnml.
+func load(model string) (*hlnet.Net, error) {
+	info, err := os.Stat(model)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		model = filepath.Join(model, "model.pnml")
+	}
+	xmlFile, err := os.Open(model)
+	if err != nil {
+		return nil, err
+	}
+	defer xmlFile.Close()
+
+	var p = new(pnml.Net)
+	if err := pnml.NewDecoder(xmlFile).Build(p); err != nil {
+		return nil, err
+	}
+	return hlnet.Build(p)
+}
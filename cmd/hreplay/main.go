@@ -0,0 +1,251 @@
+// Copyright 2023. Silvano DAL ZILIO (LAAS-CNRS). All rights reserved. Use of
+// this source code is governed by the GNU Affero license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dalzilio/hue/pkg/formula"
+	"github.com/dalzilio/hue/pkg/hlnet"
+	"github.com/dalzilio/hue/pkg/pnml"
+	flag "github.com/spf13/pflag"
+)
+
+// builddate stores the compilation date for the executable, in %Y%m%d format.
+// Set in the Makefile with the result of:
+//
+//	date -u +%d/%m/%Y
+var builddate string = "2020/01/01"
+
+// gitversion stores the current git version. Set in the makefile with the result
+// of:
+//
+//	git describe --tags --dirty --always
+var gitversion string = "v0"
+
+func main() {
+	var flaghelp = flag.BoolP("help", "h", false, "print this message")
+	var flagversion = flag.Bool("version", false, "print version number and generation date then quit")
+
+	var verbose = flag.BoolP("verbose", "v", false, "print the marking after each step")
+
+	var netfile = flag.StringP("net", "n", "", "path to PNML file (see option -d if absent)")
+	var dirfile = flag.StringP("directory", "d", "", "path to folder containing model.pnml and XML formulas")
+	var tracefile = flag.StringP("trace", "t", "", "path to the trace file, in JSON format")
+	var propfile = flag.String("xml", "", "path to XML file with the Reachability formulas")
+	var queryid = flag.StringP("query", "q", "", "ID of the query to check on the final marking (default is the one in the trace)")
+
+	flag.CommandLine.SortFlags = false
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "hreplay version %s -- %s -- LAAS/CNRS\n", gitversion, builddate)
+		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nfiles:\n")
+		fmt.Fprintf(os.Stderr, "   outfile: output is always on stdout\n")
+		fmt.Fprintf(os.Stderr, "   errorfile: error are always printed on stderr\n")
+	}
+
+	flag.Parse()
+
+	N := len(flag.Args())
+
+	switch {
+	case *flagversion:
+		fmt.Printf("hreplay version %s -- %s -- LAAS/CNRS\n", gitversion, builddate)
+		os.Exit(1)
+	case *flaghelp:
+		flag.Usage()
+		os.Exit(0)
+	case *netfile != "" && *dirfile != "":
+		fmt.Println("cannot use options --net and --directory together")
+		flag.Usage()
+		os.Exit(1)
+	case *netfile == "" && *dirfile == "":
+		fmt.Println("bad command line, missing PNML file")
+		flag.Usage()
+		os.Exit(1)
+	case N == 1 && *tracefile == "":
+		*tracefile = flag.Arg(0)
+	case N != 0:
+		fmt.Println("bad command line, too many files")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *tracefile == "" {
+		fmt.Println("bad command line, missing trace file")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// ----------------------------------------------------------------------
+	// Parsing model and trace
+
+	if *dirfile != "" {
+		*netfile = filepath.Join(*dirfile, "model.pnml")
+	}
+
+	xmlFile, err := os.Open(*netfile)
+	if err != nil {
+		log.Fatal("Error opening file: ", err)
+	}
+	defer xmlFile.Close()
+
+	var p = new(pnml.Net)
+	err = pnml.NewDecoder(xmlFile).Build(p)
+	if err != nil {
+		log.Fatal("Error decoding PNML file: ", err)
+	}
+
+	hl, err := hlnet.Build(p)
+	if err != nil {
+		log.Fatal("Error decoding PNML file: ", err)
+	}
+
+	b, err := os.ReadFile(*tracefile)
+	if err != nil {
+		log.Fatal("Error opening file: ", err)
+	}
+
+	var jtrace hlnet.JSONTrace
+	err = json.Unmarshal(b, &jtrace)
+	if err != nil {
+		log.Fatal("Error decoding trace file: ", err)
+	}
+
+	if jtrace.Net != "" && jtrace.Net != hl.Name {
+		log.Printf("Warning: trace is for net %s but model is %s\n", jtrace.Net, hl.Name)
+	}
+
+	steps, err := hl.ParseJSONTrace(jtrace)
+	if err != nil {
+		log.Fatal("Error decoding trace file: ", err)
+	}
+
+	// ----------------------------------------------------------------------
+	// Replaying the trace from the initial marking
+
+	w := hlnet.NewWorker(hlnet.NewStepper(hl, 0))
+	if *verbose {
+		fmt.Print(w)
+	}
+
+	for i, st := range steps {
+		if err := w.FireBinding(st.Trans, st.Env); err != nil {
+			fmt.Printf("REPLAY FAILED at step %d: %s\n", i+1, err)
+			os.Exit(1)
+		}
+		if *verbose {
+			fmt.Println("----------------------------------")
+			fmt.Printf("%s %s\n", hl.Trans[st.Trans].Name, hl.PrintVEnv(st.Env))
+			fmt.Println("----------------------------------")
+			fmt.Print(w)
+		}
+	}
+
+	fmt.Printf("REPLAY OK: %d step(s)\n", len(steps))
+
+	// We check that we reach the marking found in the trace, if any.
+	if jtrace.Marking != nil {
+		final := hl.JSONTrace(w.Trace()).Marking
+		if !sameMarking(final, jtrace.Marking) {
+			fmt.Println("MARKING DIFFERS from the one in the trace")
+			os.Exit(1)
+		}
+	}
+
+	// ----------------------------------------------------------------------
+	// Checking the query on the final marking
+
+	if *queryid == "" {
+		*queryid = jtrace.Query
+	}
+
+	if *propfile == "" && *dirfile != "" && *queryid != "" {
+		switch {
+		case strings.Contains(*queryid, "ReachabilityCardinality"):
+			*propfile = filepath.Join(*dirfile, "ReachabilityCardinality.xml")
+		case strings.Contains(*queryid, "ReachabilityFireability"):
+			*propfile = filepath.Join(*dirfile, "ReachabilityFireability.xml")
+		}
+	}
+
+	if *propfile == "" || *queryid == "" {
+		return
+	}
+
+	propFile, err := os.Open(*propfile)
+	if err != nil {
+		log.Fatal("Error opening file: ", err)
+	}
+	defer propFile.Close()
+
+	queries, err := formula.NewDecoder(propFile).Build()
+	if err != nil {
+		log.Fatal("Error decoding Formula file: ", err)
+	}
+
+	for _, q := range queries {
+		if q.ID != *queryid {
+			continue
+		}
+		// EF phi is TRUE if we reach a state where phi is true; AG phi is
+		// FALSE if we reach a state where phi is false.
+		b, err := w.Evaluate(q.Formula)
+		if err != nil {
+			// same output than uwalk, with the reason on stderr
+			fmt.Printf("FORMULA %s CANNOT_COMPUTE\n", q.ID)
+			log.Printf("cannot compute formula %s: %s\n", q.ID, err)
+			os.Exit(1)
+		}
+		v, ok := b.Value()
+		if !ok {
+			fmt.Printf("FORMULA %s CANNOT_COMPUTE\n", q.ID)
+			os.Exit(1)
+		}
+		if v != q.IsEF {
+			fmt.Printf("FORMULA %s is not decided by the trace\n", q.ID)
+			os.Exit(1)
+		}
+		verdict := formula.From(q.IsEF)
+		fmt.Printf("FORMULA %s %s\n", q.ID, verdict)
+		if jtrace.Verdict != "" && jtrace.Verdict != verdict.String() {
+			fmt.Printf("VERDICT DIFFERS from the one in the trace (%s)\n", jtrace.Verdict)
+			os.Exit(1)
+		}
+		return
+	}
+
+	log.Fatalf("query %s not found in %s", *queryid, *propfile)
+}
+
+// sameMarking reports whether two markings in JSON format are equal.
+func sameMarking(m1, m2 map[string][]hlnet.JSONAtom) bool {
+	count := func(m map[string][]hlnet.JSONAtom) map[string]int {
+		res := make(map[string]int)
+		for pl, atoms := range m {
+			for _, a := range atoms {
+				res[pl+" "+a.Value] += a.Mult
+			}
+		}
+		return res
+	}
+	c1, c2 := count(m1), count(m2)
+	if len(c1) != len(c2) {
+		return false
+	}
+	for k, v := range c1 {
+		if c2[k] != v {
+			return false
+		}
+	}
+	return true
+}
@@ -5,6 +5,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
@@ -38,6 +39,8 @@ type qflags struct {
 	reach         bool
 	fire          bool
 	countlimit    int
+	statelimit    int
+	tracedir      string
 }
 
 // qlist is a concurrency-safe list of query ids that still need to be
@@ -52,17 +55,11 @@ type qlist struct {
 type qmessage struct {
 	id      int
 	verdict formula.Bool
+	trace   *hlnet.Trace // nil when we do not record traces
+	err     error        // reason why the query cannot be computed, if any
 }
 
 func main() {
-
-	// Current known limitations on the models in the MCC
-	//
-	// * cannot fire transition "Start" on model DatabaseWithMutex; extra
-	//   variable in the output arcs
-	// * cannot check fireability on model PhilosophersDyn; more variables on
-	//   the transition condition than on the input arc + some arcs have an <All>
-	//   expression in their pattern. Same with VehicularWifi-COL-none
 	var flaghelp = flag.BoolP("help", "h", false, "print this message")
 	var flagversion = flag.Bool("version", false, "print version number and generation date then quit")
 
@@ -83,9 +80,13 @@ func main() {
 	var countlimit = flag.IntP("limit-count", "c", 1, "limit on length of exploration path (0 means none)")
 	// var flagtimelimit = flag.IntP("limit-time", "t", 0, "limit on time of exploration (0 means none)")
 	var flagparallel = flag.IntP("parallel", "p", 4, "number of walkers operating in parallel")
+	var seed = flag.Int64("seed", 0, "seed for the random walkers (default is based on the current time)")
+	var explore = flag.BoolP("explore", "e", false, "exhaustive exploration of the state space instead of random walks")
+	var statelimit = flag.Int("limit-states", 0, "limit on the number of states with option -e (0 means none)")
 
 	var testfsimplify = flag.Bool("test-simplify", false, "print warning if formulas before and after simplification give different results")
 	var showqueries = flag.Bool("show-queries", false, "print queries on standard output")
+	var tracedir = flag.String("trace", "", "path to folder where we write a trace for every decided query")
 
 	flag.CommandLine.SortFlags = false
 
@@ -109,6 +110,8 @@ func main() {
 		reach:         *reach,
 		fire:          *fire,
 		countlimit:    *countlimit,
+		statelimit:    *statelimit,
+		tracedir:      *tracedir,
 	}
 
 	N := len(flag.Args())
@@ -154,14 +157,10 @@ func main() {
 
 	sort.Ints(selectQueries)
 
-	// we capture panics when in quiet/competition mode
+	// we keep error messages, like the reason why a formula cannot be
+	// computed, as short as possible in quiet/competition mode
 	if *flagquiet {
-		defer func() {
-			if r := recover(); r != nil {
-				log.Fatal("error in generation: cannot compute")
-				os.Exit(1)
-			}
-		}()
+		log.SetFlags(0)
 	}
 
 	// ----------------------------------------------------------------------
@@ -227,18 +226,33 @@ func main() {
 	// computing fireability information that we check cardinality information
 	// on the initial marking, but this is not useful in practice.
 
-	s := hlnet.NewStepper(hl)
+	// Runs with the same seed, number of walkers and count limit should give
+	// the same results.
+	if !flag.CommandLine.Changed("seed") {
+		*seed = time.Now().UnixNano()
+	}
+
+	s := hlnet.NewStepper(hl, *seed)
 
 	if rflags.verbose {
 		elapsed := time.Since(start)
 		fmt.Fprintf(os.Stdout, "# net %s, %d place(s), %d transition(s), %.3fs\n", hl.Name, len(hl.Places), len(hl.Trans), elapsed.Seconds())
+		fmt.Fprintf(os.Stdout, "# seed %d\n", *seed)
 		fmt.Fprintf(os.Stdout, "%s\n", hl)
 		fmt.Println("")
 	}
 
 	// -------------------------------------------------------------------------
 	// In the absence of queries: we do not parse formula and we simply execute
-	// one walker.
+	// one walker, or compute the size of the state space with option -e.
+
+	if *explore && !rflags.fire && !rflags.reach {
+		x := hlnet.NewExplorer(s)
+		x.MaxStates = rflags.statelimit
+		x.Explore(nil)
+		fmt.Printf("# %s\n", x.Stats)
+		return
+	}
 
 	if !rflags.fire && !rflags.reach {
 		w := hlnet.NewWorker(s)
@@ -340,13 +354,19 @@ func main() {
 		fmt.Println("")
 	}
 
+	if *explore {
+		queryexplorer(s, &worklist, rflags)
+		return
+	}
+
 	// We can receive messages from all the workers at the same time. We expect
 	// a pair of the query index and its verdict.
 	msgmain := make(chan qmessage, *flagparallel*len(worklist.queries))
 	// We use msgend to signal the end of processing to the main function
 	msgend := make(chan bool, 1)
 	// We also use a WaitGroup to detect when all the workers have finished
-	// (typically, when they have reached their count limit)
+	// (typically, when they have reached their count limit), in which case we
+	// close msgmain.
 	var wg sync.WaitGroup
 	wg.Add(*flagparallel)
 	// We have a channel for each worker, used to receive information about
@@ -360,8 +380,7 @@ func main() {
 
 	}
 
-	go querycoordinator(&worklist, rflags,
-		&wg, msgend, msgmain, msgworkers)
+	go querycoordinator(hl, &worklist, rflags, msgend, msgmain, msgworkers)
 
 	for i := 0; i < *flagparallel; i++ {
 		// queries is only used for read access, so we can share it between
@@ -370,24 +389,52 @@ func main() {
 			&wg, msgmain, msgworkers[i])
 	}
 
+	// The workers are the only senders on msgmain. Once they have all
+	// finished, we close the channel so that the coordinator can process the
+	// remaining messages before sending the end event.
+	go func() {
+		wg.Wait()
+		close(msgmain)
+	}()
+
 	// We wait from querycoordinator to send an end event.
 	<-msgend
 }
 
 // ----------------------------------------------------------------------
 
+// queryexplorer evaluates the active queries using an exhaustive exploration of
+// the state space and prints the verdicts that could be decided.
+func queryexplorer(s *hlnet.Stepper, worklist *qlist, flags qflags) {
+	x := hlnet.NewExplorer(s)
+	x.MaxStates = flags.statelimit
+	queries := []formula.Query{}
+	for k, b := range worklist.queriesactive {
+		if b {
+			queries = append(queries, worklist.queries[k])
+		}
+	}
+	verdicts := x.Explore(queries)
+	if flags.verbose {
+		fmt.Printf("# %s\n", x.Stats)
+	}
+	for k, v := range verdicts {
+		if _, ok := v.Value(); ok {
+			fmt.Printf("FORMULA %s %s\n", queries[k].ID, v)
+		}
+	}
+}
+
+// ----------------------------------------------------------------------
+
 // querycoordinator manages the queue of query identifiers that should be
 // checked. It is in charge of printing the result to the standard output. It
 // receives information form workers when a verdict has been found and broadcast
-// the information to all the workers.
-func querycoordinator(worklist *qlist, flags qflags,
-	wg *sync.WaitGroup, msgend chan<- bool, msgmain <-chan qmessage, msgworkers []chan bool) {
-
-	go func() {
-		// if all the workers have finished, we signal the main program
-		wg.Wait()
-		msgend <- true
-	}()
+// the information to all the workers. We signal the main program on msgend
+// when all the queries are decided, or when msgmain is closed and all the
+// messages have been processed.
+func querycoordinator(hl *hlnet.Net, worklist *qlist, flags qflags,
+	msgend chan<- bool, msgmain <-chan qmessage, msgworkers []chan bool) {
 
 	for qm := range msgmain {
 		// we receive a result for query qm.id
@@ -397,7 +444,17 @@ func querycoordinator(worklist *qlist, flags qflags,
 				fmt.Println("")
 			}
 			worklist.mu.Lock()
-			fmt.Printf("FORMULA %s %s\n", worklist.queries[qm.id].ID, qm.verdict)
+			if qm.err != nil {
+				// we give up on this query; the reason is printed on stderr
+				// so that stdout only contains MCC answers
+				fmt.Printf("FORMULA %s CANNOT_COMPUTE\n", worklist.queries[qm.id].ID)
+				log.Printf("cannot compute formula %s: %s\n", worklist.queries[qm.id].ID, qm.err)
+			} else {
+				fmt.Printf("FORMULA %s %s\n", worklist.queries[qm.id].ID, qm.verdict)
+			}
+			if qm.trace != nil {
+				writetrace(hl, flags.tracedir, worklist.queries[qm.id], qm.verdict, qm.trace)
+			}
 			worklist.queriesactive[qm.id] = false
 			worklist.nbactivequeries--
 			worklist.mu.Unlock()
@@ -411,6 +468,8 @@ func querycoordinator(worklist *qlist, flags qflags,
 			}
 		}
 	}
+	// all the workers have finished
+	msgend <- true
 }
 
 // queryworker manages a walker working in parallel with the others. It sends a
@@ -450,15 +509,23 @@ func queryworker(id int, w *hlnet.Worker, queries []formula.Query, worklist *qli
 				continue
 			}
 			var v formula.Bool
+			var err error
 
 			if flags.reach {
-				v = w.EvaluateCardinalityQueries(queries[k])
+				v, err = w.EvaluateCardinalityQueries(queries[k])
 			} else {
-				v = w.EvaluateFireabilityQueries(queries[k])
+				v, err = w.EvaluateFireabilityQueries(queries[k])
+			}
+
+			if err != nil {
+				msgmain <- qmessage{id: k, err: err}
+				queriesactive[k] = false
+				nbactivequeries--
+				continue
 			}
 
 			if flags.testfsimplify {
-				if !w.EvaluateAndTestSimplify(queries[k]) {
+				if ok, _ := w.EvaluateAndTestSimplify(queries[k]); !ok {
 					fmt.Println("----------------------------------")
 					fmt.Printf("SIMPLIFY ERROR in formula %s\n", queries[k].ID)
 					fmt.Fprintf(os.Stdout, "ORIGINAL: %s\n", queries[k].Original.String())
@@ -468,8 +535,21 @@ func queryworker(id int, w *hlnet.Worker, queries []formula.Query, worklist *qli
 			}
 
 			if _, ok := v.Value(); ok {
-				// We have a new verdict. We send it to the coordinator.
-				msgmain <- qmessage{k, v}
+				// We have a new verdict. We send it to the coordinator,
+				// together with a trace leading to the marking where it was
+				// decided. There is no trace when the formula was decided by
+				// simplification alone, like with AG TRUE, since the verdict
+				// does not depend on the marking.
+				var trace *hlnet.Trace
+				_, constant := queries[k].Formula.(formula.BooleanConstant)
+				if flags.tracedir != "" && !constant {
+					if flags.reach {
+						trace = w.CardinalityTrace(queries[k])
+					} else {
+						trace = w.Trace()
+					}
+				}
+				msgmain <- qmessage{id: k, verdict: v, trace: trace}
 				// We can skip this query from now.
 				queriesactive[k] = false
 				nbactivequeries--
@@ -497,3 +577,29 @@ func queryworker(id int, w *hlnet.Worker, queries []formula.Query, worklist *qli
 		}
 	}
 }
+
+// ----------------------------------------------------------------------
+
+// writetrace saves a trace for query q in folder dir, both in a readable form
+// (file with extension .txt) and in JSON (extension .json). The files are named
+// after the query ID.
+func writetrace(hl *hlnet.Net, dir string, q formula.Query, verdict formula.Bool, trace *hlnet.Trace) {
+	header := fmt.Sprintf("# FORMULA %s %s (net %s, %d step(s))\n", q.ID, verdict, hl.Name, len(trace.Steps))
+	err := os.WriteFile(filepath.Join(dir, q.ID+".txt"), []byte(header+hl.PrintTrace(trace)), 0644)
+	if err != nil {
+		log.Println("Error writing trace:", err)
+		return
+	}
+	jtrace := hl.JSONTrace(trace)
+	jtrace.Query = q.ID
+	jtrace.Verdict = verdict.String()
+	b, err := json.MarshalIndent(jtrace, "", "  ")
+	if err != nil {
+		log.Println("Error writing trace:", err)
+		return
+	}
+	err = os.WriteFile(filepath.Join(dir, q.ID+".json"), b, 0644)
+	if err != nil {
+		log.Println("Error writing trace:", err)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2023. Silvano DAL ZILIO (LAAS-CNRS). All rights reserved. Use of
+// this source code is governed by the GNU Affero license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// TestMain runs the uwalk command instead of the tests when variable
+// UWALK_TEST_MAIN is set. This way, tests can call the test binary as if it
+// was uwalk, see runUwalk.
+func TestMain(m *testing.M) {
+	if os.Getenv("UWALK_TEST_MAIN") != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runUwalk runs uwalk with arguments args and returns the FORMULA lines
+// printed on the standard output, in sorted order.
+func runUwalk(t *testing.T, args ...string) []string {
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "UWALK_TEST_MAIN=1")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("uwalk %s: %s", strings.Join(args, " "), err)
+	}
+	res := []string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "FORMULA") {
+			res = append(res, line)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+func TestSeed(t *testing.T) {
+	// walkers are created with the same seeds, so they find the same verdicts,
+	// even if not in the same order
+	args := []string{"-d", "../../benchmarks/SharedMemory-COL-000005", "-f", "-c", "300", "-p", "3", "--seed", "7"}
+	first := runUwalk(t, args...)
+	if len(first) == 0 {
+		t.Fatalf("uwalk %s: no verdict found", strings.Join(args, " "))
+	}
+	for i := 0; i < 5; i++ {
+		res := runUwalk(t, args...)
+		if strings.Join(res, "\n") != strings.Join(first, "\n") {
+			t.Fatalf("uwalk %s: results differ between runs:\n%s\nand\n%s", strings.Join(args, " "), strings.Join(first, "\n"), strings.Join(res, "\n"))
+		}
+	}
+}
+
+func TestTrace(t *testing.T) {
+	// query 05 is simplified into AG TRUE, so it has no trace. We write a
+	// trace for every other verdict.
+	dir := t.TempDir()
+	args := []string{"-d", "../../benchmarks/PhilosophersDyn-COL-03", "-f", "-c", "3000", "-p", "2", "--seed", "1", "--trace", dir}
+	for _, line := range runUwalk(t, args...) {
+		id := strings.Fields(line)[1]
+		_, err := os.Stat(filepath.Join(dir, id+".json"))
+		switch {
+		case strings.HasSuffix(id, "-05") && err == nil:
+			t.Errorf("uwalk: formula %s is constant and should have no trace", id)
+		case !strings.HasSuffix(id, "-05") && err != nil:
+			t.Errorf("uwalk: no trace for formula %s: %s", id, err)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2023. Silvano DAL ZILIO (LAAS-CNRS). All rights reserved. Use of
+// this source code is governed by the GNU Affero license that can be found in
+// the LICENSE file.
+
+package formula
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// propXML is a property file with two formulas, EF (p <= 2) and AG not t.
+const propXML = `<?xml version="1.0"?>
+<property-set xmlns="http://mcc.lip6.fr/">
+  <property>
+    <id>net-00</id>
+    <formula><exists-path><finally>
+      <integer-le>
+        <tokens-count><place>p</place></tokens-count>
+        <integer-constant>2</integer-constant>
+      </integer-le>
+    </finally></exists-path></formula>
+  </property>
+  <property>
+    <id>net-01</id>
+    <formula><all-paths><globally>
+      <negation><is-fireable><transition>t</transition></is-fireable></negation>
+    </globally></all-paths></formula>
+  </property>
+</property-set>`
+
+func TestSyntaxError(t *testing.T) {
+	queries, err := NewDecoder(strings.NewReader(propXML)).Build()
+	if err != nil {
+		t.Fatalf("formula.Build(): %s", err)
+	}
+	if len(queries) != 2 || !queries[0].IsEF || queries[1].IsEF {
+		t.Fatalf("formula.Build(): expected one EF and one AG query, not %v", queries)
+	}
+
+	// the error can be on the first line of the formula, where the column
+	// should be shifted, or on a later line
+	for _, old := range []string{`<globally>`, `<negation>`} {
+		bad := strings.Replace(propXML, old, old+`<foo/>`, 1)
+		i := strings.Index(bad, "<foo/>")
+		line := strings.Count(bad[:i], "\n") + 1
+		col := i - strings.LastIndex(bad[:i], "\n")
+		_, err = NewDecoder(strings.NewReader(bad)).Build()
+		var serr *SyntaxError
+		if !errors.As(err, &serr) {
+			t.Fatalf("formula.Build(): expected a syntax error, not %v", err)
+		}
+		if serr.Line != line || serr.Col != col || serr.ID != "net-01" {
+			t.Errorf("formula.Build(): error should be at line %d, column %d in net-01, not %s", line, col, serr)
+		}
+	}
+}
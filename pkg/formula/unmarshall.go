@@ -7,11 +7,12 @@ package formula
 import (
 	"bytes"
 	"encoding/xml"
-	"errors"
 	"fmt"
 	"io"
 	"sort"
 	"strconv"
+
+	"github.com/dalzilio/hue/pkg/internal/rawxml"
 )
 
 // ----------------------------------------------------------------------
@@ -46,10 +47,20 @@ type Property struct {
 	AG RawXML `xml:"formula>all-paths>globally,omitempty"`
 }
 
-// StateFormula is a Boolean combination of atomic properties and integer
-// expressions that we should parse explicitly.
-type RawXML struct {
-	InnerXML []byte `xml:",innerxml"`
+// RawXML is the type of the state formulas in a property. A state formula is a
+// Boolean combination of atomic properties and integer expressions that we
+// parse explicitly (see parseFormula), after decoding the property file.
+type RawXML = rawxml.RawXML
+
+// SyntaxError is the type of errors found when parsing the formulas in a
+// property file. ID is the identifier of the enclosing property.
+type SyntaxError = rawxml.SyntaxError
+
+// malformed returns a SyntaxError at position (line, col) in the formula being
+// parsed. The position is relative to the start of the formula; it is
+// translated to a position in the file by parseFormula.
+func malformed(line, col int, format string, a ...interface{}) error {
+	return &SyntaxError{Kind: "formula", Line: line, Col: col, Msg: fmt.Sprintf(format, a...)}
 }
 
 type Places struct {
@@ -67,20 +78,22 @@ type Constant struct {
 // ----------------------------------------------------------------------
 
 // parseFormula returns the state formula corresponding to the XML content
-// found in the provided byte slice.
-func parseFormula(b []byte) (Formula, error) {
-	if len(b) == 0 {
+// found in raw. Parameter id is the identifier of the enclosing property. It
+// is added, together with the position in the file, to syntax errors.
+func parseFormula(raw RawXML, id string) (Formula, error) {
+	if len(raw.InnerXML) == 0 {
 		return nil, nil
 	}
-	buff := bytes.NewBuffer(b)
+	buff := bytes.NewBuffer(raw.InnerXML)
 	decoder := xml.NewDecoder(buff)
-	return parseElement(decoder)
+	res, err := parseElement(decoder)
+	return res, raw.Locate(err, id)
 }
 
 func parseMult(d *xml.Decoder, acc []Formula) ([]Formula, error) {
 	res, err := parseElement(d)
 	if err != nil {
-		return nil, fmt.Errorf(" parsing multiple elements: %s", err)
+		return nil, err
 	}
 	if res == nil {
 		return acc, nil
@@ -109,6 +122,9 @@ func skipUntilEnd(d *xml.Decoder) error {
 }
 
 func parseElement(decoder *xml.Decoder) (Formula, error) {
+	// we record the position of the element before reading it, so that errors
+	// point to its start tag
+	line, col := decoder.InputPos()
 	t, _ := decoder.Token()
 	if t == nil {
 		return nil, nil
@@ -169,7 +185,7 @@ func parseElement(decoder *xml.Decoder) (Formula, error) {
 				return nil, err
 			}
 			if len(ee) != 2 {
-				return nil, errors.New("malformed Formula: integer-le does not have two operands")
+				return nil, malformed(line, col, "integer-le does not have two operands")
 			}
 			return IntegerLe{
 				Left:  ee[0],
@@ -179,18 +195,18 @@ func parseElement(decoder *xml.Decoder) (Formula, error) {
 			var cst Constant
 			err := decoder.DecodeElement(&cst, &se)
 			if err != nil {
-				return nil, err
+				return nil, malformed(line, col, "bad <%s>: %s", se.Name.Local, err)
 			}
 			v, err := strconv.Atoi(string(cst.Value))
 			if err != nil {
-				return nil, err
+				return nil, malformed(line, col, "bad integer constant %q", cst.Value)
 			}
 			return IntegerConstant(v), nil
 		case "is-fireable":
 			var tr Transitions
 			err := decoder.DecodeElement(&tr, &se)
 			if err != nil {
-				return nil, err
+				return nil, malformed(line, col, "bad <%s>: %s", se.Name.Local, err)
 			}
 			sort.Strings(tr.TrList)
 			return IsFireable(tr.TrList), nil
@@ -198,15 +214,15 @@ func parseElement(decoder *xml.Decoder) (Formula, error) {
 			var pl Places
 			err := decoder.DecodeElement(&pl, &se)
 			if err != nil {
-				return nil, err
+				return nil, malformed(line, col, "bad <%s>: %s", se.Name.Local, err)
 			}
 			sort.Strings(pl.PlList)
 			return TokensCount(pl.PlList), nil
 		default:
-			return nil, errors.New("malformed XML: unexpected Token <" + se.Name.Local + ">")
+			return nil, malformed(line, col, "unexpected element <%s>", se.Name.Local)
 		}
 	}
-	return nil, errors.New("malformed XML: unexpected Token in parseFormula")
+	return nil, malformed(line, col, "unexpected token %T", t)
 }
 
 // ----------------------------------------------------------------------
@@ -222,15 +238,15 @@ func (d *Decoder) Build() ([]Query, error) {
 
 	for k, p := range props.List {
 		if len(p.EF.InnerXML) != 0 {
-			ff, err := parseFormula(p.EF.InnerXML)
+			ff, err := parseFormula(p.EF, p.Id)
 			if err != nil {
-				return nil, fmt.Errorf(" decoding XML input in EF query %d : %s", k, err)
+				return nil, fmt.Errorf(" decoding XML input in EF query %d : %w", k, err)
 			}
 			res[k] = Query{ID: p.Id, IsEF: true, Original: ff, Formula: Simplify(ff)}
 		} else {
-			ff, err := parseFormula(p.AG.InnerXML)
+			ff, err := parseFormula(p.AG, p.Id)
 			if err != nil {
-				return nil, fmt.Errorf(" decoding XML input in AG query %d : %s", k, err)
+				return nil, fmt.Errorf(" decoding XML input in AG query %d : %w", k, err)
 			}
 			res[k] = Query{ID: p.Id, IsEF: false, Original: ff, Formula: Simplify(ff)}
 		}
@@ -0,0 +1,191 @@
+// Copyright 2023. Silvano DAL ZILIO (LAAS-CNRS). All rights reserved. Use of
+// this source code is governed by the GNU Affero license that can be found in
+// the LICENSE file.
+
+package hlnet
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dalzilio/hue/pkg/pnml"
+)
+
+// Binding is a possible way to fire a transition from the current marking. It
+// is an association between the variables of the transition and values, Env,
+// together with the marking obtained after firing the transition, After.
+type Binding struct {
+	Env   pnml.VEnv
+	After pnml.Marking
+}
+
+// Bindings returns all the bindings for which transition k is enabled at the
+// current marking. The result is empty if the transition is not enabled. We
+// return an error if we cannot compute the successors of the transition (for
+// instance if it belongs to forbidFiring).
+//
+// Bindings uses the same iterator than computeEnabled but does not change the
+// value of After. The transition is marked as dirty so that its witness, and
+// the environment of its iterator, are computed again after the next update.
+func (w *Worker) Bindings(k int) ([]Binding, error) {
+	if _, ok := w.forbidEnabled[k]; ok {
+		return nil, fmt.Errorf("cannot decide if transition %s is enabled", w.Trans[k].Name)
+	}
+	if _, ok := w.forbidFiring[k]; ok {
+		return nil, fmt.Errorf("cannot fire transition %s", w.Trans[k].Name)
+	}
+
+	res := []Binding{}
+	for _, a := range w.iter[k].arcs {
+		if len(w.COL[a.pl]) == 0 {
+			return res, nil
+		}
+	}
+
+	w.dirty[k] = true
+	w.reset(k)
+	ok, err := w.search(k)
+	for ok {
+		var after pnml.Marking
+		if after, err = w.getWitness(k); err != nil {
+			break
+		}
+		res = append(res, Binding{Env: w.iter[k].Environment(), After: after})
+		if !w.next(k) {
+			break
+		}
+		ok, err = w.search(k)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// randomBinding returns a binding chosen uniformly at random among the ones
+// for which transition k is enabled at the current marking, and false if k is
+// not enabled. It enumerates the same matches than Bindings, but we only keep
+// one of them (using reservoir sampling), so that we compute the marking after
+// firing k for a few matches only. Like with Bindings, the transition is
+// marked as dirty.
+func (w *Worker) randomBinding(k int) (Binding, bool, error) {
+	if _, ok := w.forbidEnabled[k]; ok {
+		return Binding{}, false, fmt.Errorf("cannot decide if transition %s is enabled", w.Trans[k].Name)
+	}
+	if _, ok := w.forbidFiring[k]; ok {
+		return Binding{}, false, fmt.Errorf("cannot fire transition %s", w.Trans[k].Name)
+	}
+
+	for _, a := range w.iter[k].arcs {
+		if len(w.COL[a.pl]) == 0 {
+			return Binding{}, false, nil
+		}
+	}
+
+	w.dirty[k] = true
+	w.reset(k)
+	var res Binding
+	n := 0
+	ok, err := w.search(k)
+	for ok {
+		n++
+		if w.rand.Intn(n) == 0 {
+			if res.After, err = w.getWitness(k); err != nil {
+				break
+			}
+			res.Env = w.iter[k].Environment()
+		}
+		if !w.next(k) {
+			break
+		}
+		ok, err = w.search(k)
+	}
+	if err != nil {
+		return Binding{}, false, err
+	}
+	return res, n != 0, nil
+}
+
+// ----------------------------------------------------------------------
+
+// NotEnabledError is the type of errors returned by FireBinding when a
+// transition is not enabled for a given binding. Reason gives a readable
+// explanation.
+type NotEnabledError struct {
+	Trans  string
+	Reason string
+}
+
+func (e *NotEnabledError) Error() string {
+	return fmt.Sprintf("transition %s is not enabled: %s", e.Trans, e.Reason)
+}
+
+// FireBinding fires transition k using the association between variables and
+// values in venv, and updates the current marking. Unlike with Fire, the
+// binding is not computed by an iterator, which means that we can also fire
+// transitions in forbidFiring when venv gives a value to all their variables.
+// We return a *NotEnabledError, and leave the marking unchanged, if the
+// transition is not enabled for this binding.
+func (w *Worker) FireBinding(k int, venv pnml.VEnv) error {
+	tr := w.Trans[k]
+	for _, v := range tr.Env {
+		if venv[v] == nil {
+			return &NotEnabledError{Trans: tr.Name, Reason: fmt.Sprintf("variable %s is not bound", v)}
+		}
+	}
+
+	ok, err := tr.Cond.OK(w.Net.Net, venv)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return &NotEnabledError{Trans: tr.Name, Reason: "condition " + tr.Cond.String() + " is false"}
+	}
+
+	m1 := w.COL.Clone()
+
+	// We start by removing the Pre. We accumulate the values matched by the
+	// patterns in each place before checking that we have enough tokens.
+	pre := make(map[int]pnml.Hue)
+	for _, a := range tr.Ins {
+		for _, e := range a.Pattern {
+			m, err := e.Eval(w.Net.Net, venv)
+			if errors.Is(err, pnml.ErrUndefined) {
+				return &NotEnabledError{Trans: tr.Name, Reason: "pattern " + e.String() + " is undefined"}
+			}
+			if err != nil {
+				return err
+			}
+			pre[a.Place] = pre[a.Place].Union(m)
+		}
+	}
+	for pl, h := range pre {
+		for _, atom := range h {
+			if m1[pl].Mult(atom.Value) < atom.Mult {
+				return &NotEnabledError{
+					Trans:  tr.Name,
+					Reason: fmt.Sprintf("not enough tokens %s in place %s", w.PrintValue(atom.Value), w.Places[pl].Name),
+				}
+			}
+		}
+		m1[pl] = m1[pl].Diff(h)
+	}
+
+	// We add the Post.
+	for _, a := range tr.Outs {
+		for _, e := range a.Pattern {
+			m, err := e.Eval(w.Net.Net, venv)
+			if errors.Is(err, pnml.ErrUndefined) {
+				return &NotEnabledError{Trans: tr.Name, Reason: "pattern " + e.String() + " is undefined"}
+			}
+			if err != nil {
+				return err
+			}
+			m1[a.Place] = m1[a.Place].Union(m)
+		}
+	}
+
+	w.trace = append(w.trace, Step{Trans: k, Env: venv.Clone()})
+	w.update(m1)
+	return nil
+}
@@ -0,0 +1,272 @@
+// Copyright 2023. Silvano DAL ZILIO (LAAS-CNRS). All rights reserved. Use of
+// this source code is governed by the GNU Affero license that can be found in
+// the LICENSE file.
+
+package hlnet
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/dalzilio/hue/pkg/pnml"
+)
+
+// Feature describes a construct of a net that is not supported, or only
+// approximated, by the stepper. Kind is one of the constants below, Node is
+// the declaration, transition or arc where it occurs and Detail gives more
+// information, like the reason why a transition is forbidden.
+type Feature struct {
+	Kind   string `json:"kind"`
+	Node   string `json:"node"`
+	Detail string `json:"detail"`
+}
+
+// Kinds of features listed in a Report.
+const (
+	FeatureForbidFiring  = "forbid-firing"      // transition that we never fire
+	FeatureForbidEnabled = "forbid-enabled"     // transition whose enabledness is undecided
+	FeaturePartition     = "partition"          // partition declaration
+	FeaturePartitionOf   = "partitionelementof" // use of partitionelementof
+	FeatureAllInput      = "all-input"          // <all> in an input arc
+	FeatureMultisetInput = "multiset-input"     // other multiset pattern in an input arc
+	FeatureGroundOnly    = "ground-only"        // input pattern that can only be checked, not unified
+	FeatureUnknown       = "unknown-expression" // expression that is not handled at all
+)
+
+// SortStats gives the kind of a sort and its number of values. Card is -1 for
+// infinite sorts, like integers.
+type SortStats struct {
+	ID   string `json:"id"`
+	Kind string `json:"kind"`
+	Card int    `json:"card"`
+}
+
+// Report is the result of Diagnose. It gives statistics on the net together
+// with the list of its unsupported or approximated features.
+type Report struct {
+	Net         string      `json:"net"`
+	Places      int         `json:"places"`
+	Transitions int         `json:"transitions"`
+	Arcs        int         `json:"arcs"`
+	Variables   int         `json:"variables"`
+	Sorts       []SortStats `json:"sorts"`
+	Features    []Feature   `json:"features"`
+}
+
+// Diagnose returns a report on net n. We list the features found by looking
+// at the declarations and the arc patterns, but also the transitions that are
+// forbidden, either statically (for instance because of a free variable with
+// an infinite sort) or after firing up to steps transitions at random. Some
+// problems only occur on specific markings, so a net without forbidden
+// transitions in the report can still have some later on.
+func Diagnose(n *Net, steps int, seed int64) *Report {
+	r := &Report{
+		Net:         n.Name,
+		Places:      len(n.Places),
+		Transitions: len(n.Trans),
+		Variables:   len(n.TypeEnvt),
+		Sorts:       []SortStats{},
+		Features:    []Feature{},
+	}
+	for _, s := range n.Declaration.Sorts {
+		card := -1
+		if w, ok := n.World[s.ID]; ok {
+			card = len(w)
+		}
+		r.Sorts = append(r.Sorts, SortStats{ID: s.ID, Kind: s.Sort.String(), Card: card})
+	}
+
+	for _, p := range n.Declaration.Partitions {
+		r.add(FeaturePartition, "sort "+p.Type.ID, "partition %s with %d elements", p.ID, len(p.Partitions))
+	}
+	for _, t := range n.Trans {
+		node := "transition " + t.Name
+		r.scan(node, t.Cond)
+		for _, a := range t.Ins {
+			r.Arcs++
+			node := fmt.Sprintf("arc from %s to %s", n.Places[a.Place].Name, t.Name)
+			tokens, msets := splitPatterns(a.Pattern)
+			for _, e := range msets {
+				kind := FeatureMultisetInput
+				if hasAll(e) {
+					kind = FeatureAllInput
+				}
+				r.add(kind, node, "%s is matched as a multiset, once the other variables are bound", e)
+			}
+			for _, e := range tokens {
+				r.scan(node, e)
+				switch c := groundOnly(e); {
+				case c == nil:
+				case c.String() == e.String():
+					r.add(FeatureGroundOnly, node, "%s can only be matched when its variables are bound by other arcs", e)
+				default:
+					r.add(FeatureGroundOnly, node, "%s can only be matched when the variables in %s are bound by other arcs", e, c)
+				}
+			}
+		}
+		for _, a := range t.Outs {
+			r.Arcs++
+			node := fmt.Sprintf("arc from %s to %s", t.Name, n.Places[a.Place].Name)
+			for _, e := range a.Pattern {
+				r.scan(node, e)
+			}
+		}
+	}
+
+	// Forbidden transitions are found when we build the iterators (in
+	// NewWorker) or when we check if a transition is enabled.
+	w := NewWorker(NewStepper(n, seed))
+	for i := 0; i < steps; i++ {
+		w.FireAtRandom(false)
+	}
+	for k, t := range n.Trans {
+		err := w.Forbidden(t.Name)
+		if err == nil {
+			continue
+		}
+		kind := FeatureForbidEnabled
+		if _, ok := w.forbidFiring[k]; ok {
+			kind = FeatureForbidFiring
+		}
+		detail := err.Error()
+		if !errors.Is(err, pnml.ErrUnsupportedFeature) {
+			detail = "cannot decide if the transition is enabled: " + detail
+		}
+		r.add(kind, "transition "+t.Name, "%s", detail)
+	}
+	return r
+}
+
+func (r *Report) add(kind, node, format string, a ...interface{}) {
+	r.Features = append(r.Features, Feature{Kind: kind, Node: node, Detail: fmt.Sprintf(format, a...)})
+}
+
+// scan looks for uses of partitionelementof, and for expressions that we do
+// not know, in expression e found in node.
+func (r *Report) scan(node string, e pnml.Expression) {
+	switch e := e.(type) {
+	case nil, pnml.All, pnml.BoolConstant, pnml.Constant, pnml.FIRConstant, pnml.IntConstant, pnml.Var, pnml.Dot:
+	case pnml.Add:
+		r.scanAll(node, e)
+	case pnml.Subtract:
+		r.scanAll(node, e)
+	case pnml.Tuple:
+		r.scanAll(node, e)
+	case pnml.Contains:
+		r.scanAll(node, e)
+	case pnml.Operation:
+		r.scanAll(node, e.Elem)
+	case pnml.Arithmetic:
+		r.scanAll(node, e.Elem)
+	case pnml.Successor:
+		r.scan(node, e.Expression)
+	case pnml.Numberof:
+		r.scan(node, e.Expression)
+	case pnml.ScalarProduct:
+		r.scanAll(node, []pnml.Expression{e.Mult, e.Expression})
+	case pnml.Cardinality:
+		r.scan(node, e.Expression)
+	case pnml.CardinalityOf:
+		r.scanAll(node, []pnml.Expression{e.Multiset, e.Color})
+	case pnml.PartitionElementOf:
+		r.add(FeaturePartitionOf, node, "%s", e)
+		r.scan(node, e.Expression)
+	default:
+		r.add(FeatureUnknown, node, "expression %s of type %T", e, e)
+	}
+}
+
+func (r *Report) scanAll(node string, ee []pnml.Expression) {
+	for _, e := range ee {
+		r.scan(node, e)
+	}
+}
+
+// hasAll reports whether expression e contains an <all> expression.
+func hasAll(e pnml.Expression) bool {
+	switch e := e.(type) {
+	case pnml.All:
+		return true
+	case pnml.Add:
+		return anyAll(e)
+	case pnml.Subtract:
+		return anyAll(e)
+	case pnml.Numberof:
+		return hasAll(e.Expression)
+	case pnml.ScalarProduct:
+		return hasAll(e.Expression)
+	}
+	return false
+}
+
+func anyAll(ee []pnml.Expression) bool {
+	for _, e := range ee {
+		if hasAll(e) {
+			return true
+		}
+	}
+	return false
+}
+
+// groundOnly returns the first sub-expression of token pattern e that has
+// variables but cannot be unified (see unifyGround), or nil if there is none.
+func groundOnly(e pnml.Expression) pnml.Expression {
+	switch e := e.(type) {
+	case pnml.Tuple:
+		for _, c := range e {
+			if g := groundOnly(c); g != nil {
+				return g
+			}
+		}
+		return nil
+	case pnml.Successor:
+		return groundOnly(e.Expression)
+	case pnml.Numberof:
+		return groundOnly(e.Expression)
+	case pnml.ScalarProduct:
+		if len(e.Mult.AddEnv(nil)) != 0 {
+			return e.Mult
+		}
+		return groundOnly(e.Expression)
+	case pnml.Operation:
+		if e.Op == pnml.NOT {
+			return groundOnly(e.Elem[0])
+		}
+	case pnml.Arithmetic:
+		if len(e.Elem) == 2 && (e.Op == pnml.ADDITION || e.Op == pnml.SUBTRACTION) {
+			return nil
+		}
+	case pnml.Cardinality, pnml.CardinalityOf, pnml.Contains, pnml.PartitionElementOf:
+	default:
+		return nil
+	}
+	if len(e.AddEnv(nil)) != 0 {
+		return e
+	}
+	return nil
+}
+
+// ----------------------------------------------------------------------
+
+// String returns a readable version of the report, with one line for the
+// statistics on the net, one line for each sort and one for each feature.
+func (r *Report) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "net %s: %d places, %d transitions, %d arcs, %d variables\n",
+		r.Net, r.Places, r.Transitions, r.Arcs, r.Variables)
+	for _, s := range r.Sorts {
+		card := "infinite"
+		if s.Card >= 0 {
+			card = fmt.Sprintf("%d values", s.Card)
+		}
+		fmt.Fprintf(&sb, "  sort %s (%s): %s\n", s.ID, s.Kind, card)
+	}
+	if len(r.Features) == 0 {
+		sb.WriteString("  no unsupported features\n")
+	}
+	for _, f := range r.Features {
+		fmt.Fprintf(&sb, "  %s in %s: %s\n", f.Kind, f.Node, f.Detail)
+	}
+	return sb.String()
+}
@@ -6,6 +6,7 @@ package hlnet
 
 import (
 	"github.com/dalzilio/hue/pkg/formula"
+	"github.com/dalzilio/hue/pkg/pnml"
 )
 
 // EvaluateRCQueries reports whether a ReachabilityCardinality query is true,
@@ -13,70 +14,125 @@ import (
 // evaluate the formula on both the current marking, but also all the ones
 // stored in After (list of marking reachable when firing an enabled
 // transition).
-func (w *Worker) EvaluateCardinalityQueries(q formula.Query) formula.Bool {
-	if b, ok := evaluateQ(w.PT, w.Enabled, q).Value(); ok {
-		return formula.From(b)
+func (w *Worker) EvaluateCardinalityQueries(q formula.Query) (formula.Bool, error) {
+	v, _, err := w.evaluateCardinality(q)
+	return v, err
+}
+
+// evaluateCardinality returns the same result than EvaluateCardinalityQueries
+// together with the index of the transition whose successor gave the verdict.
+// We return -1 when the verdict is obtained on the current marking or when q
+// is still undefined.
+func (w *Worker) evaluateCardinality(q formula.Query) (formula.Bool, int, error) {
+	v, err := evaluateQ(w.PT, w.Enabled, q)
+	if err != nil {
+		return formula.UNDEF, -1, err
+	}
+	if b, ok := v.Value(); ok {
+		return formula.From(b), -1, nil
 	}
 	for k, m := range w.After {
 		if w.Enabled[w.Trans[k].Name].IsTrue() {
 			if _, ok := w.forbidFiring[k]; !ok {
 				pt := make(map[string]int)
 				for k, v := range w.Places {
-					pt[v.Name] = m[k].Sum()
+					pt[v.Name] = m[k].Card()
+				}
+				v, err := evaluateQ(pt, nil, q)
+				if err != nil {
+					return formula.UNDEF, -1, err
 				}
-				v := evaluateQ(pt, nil, q)
 				if _, ok := v.Value(); ok {
-					return v
+					return v, k, nil
 				}
 			}
 		}
 	}
-	return formula.UNDEF
+	return formula.UNDEF, -1, nil
 }
 
-func (w *Worker) EvaluateFireabilityQueries(q formula.Query) formula.Bool {
+func (w *Worker) EvaluateFireabilityQueries(q formula.Query) (formula.Bool, error) {
 	return evaluateQ(nil, w.Enabled, q)
 }
 
 // evaluateQ reports whether a query is true, false, or still undefined
-func evaluateQ(tokenability map[string]int, fireability map[string]formula.Bool, q formula.Query) formula.Bool {
+func evaluateQ(tokenability map[string]int, fireability map[string]formula.Bool, q formula.Query) (formula.Bool, error) {
 	switch f := q.Formula.(type) {
 	case formula.BooleanConstant:
-		return formula.From(bool(f))
+		return formula.From(bool(f)), nil
 	default:
-		v, ok := hasReached(tokenability, fireability, f).Value()
+		b, err := hasReached(tokenability, fireability, f)
+		if err != nil {
+			return formula.UNDEF, err
+		}
+		v, ok := b.Value()
 		if ok && q.IsEF && v {
-			return formula.TRUE
+			return formula.TRUE, nil
 		}
 		if ok && !q.IsEF && !v {
-			return formula.FALSE
+			return formula.FALSE, nil
 		}
-		return formula.UNDEF
+		return formula.UNDEF, nil
 	}
 }
 
+// Evaluate reports whether formula f is true on state s. The result can be
+// UNDEF if f refers to transitions for which we cannot decide enabledness.
+func (s *State) Evaluate(f formula.Formula) (formula.Bool, error) {
+	return hasReached(s.PT, s.Enabled, f)
+}
+
 // EvaluateAndTestSimplify checks whether the formula in a query evaluates to
 // the same result than its simplification on marking m.
-func (s *State) EvaluateAndTestSimplify(q formula.Query) bool {
-	return formula.BoolCompatible(hasReached(s.PT, s.Enabled, q.Original),
-		hasReached(s.PT, s.Enabled, q.Formula))
+func (s *State) EvaluateAndTestSimplify(q formula.Query) (bool, error) {
+	v1, err := hasReached(s.PT, s.Enabled, q.Original)
+	if err != nil {
+		return false, err
+	}
+	v2, err := hasReached(s.PT, s.Enabled, q.Formula)
+	if err != nil {
+		return false, err
+	}
+	return formula.BoolCompatible(v1, v2), nil
 }
 
-// hasReached reports if formula f is true for the current marking m
-func hasReached(tokenability map[string]int, fireability map[string]formula.Bool, f formula.Formula) formula.Bool {
+// hasReached reports if formula f is true for the current marking m. We
+// return an error wrapping pnml.ErrUnsupportedFeature if f uses a construct
+// that we cannot evaluate.
+func hasReached(tokenability map[string]int, fireability map[string]formula.Bool, f formula.Formula) (formula.Bool, error) {
+	// err records the first error found in a sub-formula, since we cannot
+	// return it from the closures used with FoldOr and FoldAnd.
+	var err error
+	sub := func(x formula.Formula) formula.Bool {
+		if err != nil {
+			return formula.UNDEF
+		}
+		var v formula.Bool
+		v, err = hasReached(tokenability, fireability, x)
+		return v
+	}
+	var res formula.Bool
 	switch f := f.(type) {
 	case formula.BooleanConstant:
-		return formula.From(bool(f))
+		return formula.From(bool(f)), nil
 	case formula.Negation:
-		return formula.BoolNot(hasReached(tokenability, fireability, f.Formula))
+		res = formula.BoolNot(sub(f.Formula))
 	case formula.Disjunction:
-		return formula.FoldOr(func(x formula.Formula) formula.Bool { return hasReached(tokenability, fireability, x) }, f)
+		res = formula.FoldOr(sub, f)
 	case formula.Conjunction:
-		return formula.FoldAnd(func(x formula.Formula) formula.Bool { return hasReached(tokenability, fireability, x) }, f)
+		res = formula.FoldAnd(sub, f)
 	case formula.IntegerLe:
-		return formula.From(ComputeIntegerConstant(tokenability, f.Left) <= ComputeIntegerConstant(tokenability, f.Right))
+		left, err := ComputeIntegerConstant(tokenability, f.Left)
+		if err != nil {
+			return formula.UNDEF, err
+		}
+		right, err := ComputeIntegerConstant(tokenability, f.Right)
+		if err != nil {
+			return formula.UNDEF, err
+		}
+		return formula.From(left <= right), nil
 	case formula.IsFireable:
-		return formula.FoldOr(func(x string) formula.Bool { return fireability[x] }, f)
+		return formula.FoldOr(func(x string) formula.Bool { return fireability[x] }, f), nil
 	// case formula.ITE:
 	// 	cond := hasReached(tokenability, fireability, f.Condition)
 	// 	if b, ok := cond.Value(); ok {
@@ -96,40 +152,52 @@ func hasReached(tokenability map[string]int, fireability map[string]formula.Bool
 	// 	}
 	// 	return formula.UNDEF
 	default:
-		panic("wrong formula type in Reached")
+		return formula.UNDEF, pnml.Unsupported("formula %s of type %T", f, f)
+	}
+	if err != nil {
+		return formula.UNDEF, err
 	}
+	return res, nil
 }
 
 // ComputeIntegerConstant returns the value of an integer formula
-func ComputeIntegerConstant(tokenability map[string]int, f formula.Formula) int {
+func ComputeIntegerConstant(tokenability map[string]int, f formula.Formula) (int, error) {
 	switch f := f.(type) {
 	case formula.IntegerConstant:
-		return int(f)
+		return int(f), nil
 	case formula.TokensCount:
 		res := 0
 		for _, pname := range f {
 			res += tokenability[pname]
 		}
-		return res
+		return res, nil
 	case formula.IntegerSum:
 		res := 0
 		for _, ef := range f {
-			res += ComputeIntegerConstant(tokenability, ef)
+			n, err := ComputeIntegerConstant(tokenability, ef)
+			if err != nil {
+				return 0, err
+			}
+			res += n
 		}
-		return res
+		return res, nil
 	case formula.IntegerDifference:
 		if len(f) == 0 {
-			return 0
+			return 0, nil
 		}
-		res := ComputeIntegerConstant(tokenability, f[0])
-		if len(f) == 1 {
-			return res
+		res, err := ComputeIntegerConstant(tokenability, f[0])
+		if err != nil {
+			return 0, err
 		}
 		for i := 1; i < len(f); i++ {
-			res = res - ComputeIntegerConstant(tokenability, f[i])
+			n, err := ComputeIntegerConstant(tokenability, f[i])
+			if err != nil {
+				return 0, err
+			}
+			res = res - n
 		}
-		return res
+		return res, nil
 	default:
-		panic("wrong formula type in Compute")
+		return 0, pnml.Unsupported("integer expression %s of type %T", f, f)
 	}
 }
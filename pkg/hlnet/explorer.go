@@ -0,0 +1,156 @@
+// Copyright 2023. Silvano DAL ZILIO (LAAS-CNRS). All rights reserved. Use of
+// this source code is governed by the GNU Affero license that can be found in
+// the LICENSE file.
+
+package hlnet
+
+import (
+	"fmt"
+
+	"github.com/dalzilio/hue/pkg/formula"
+	"github.com/dalzilio/hue/pkg/pnml"
+)
+
+// Explorer is used to perform an exhaustive exploration of the (colored) state
+// space of a net. Unlike random walks, this can be used to prove that an AG
+// query is TRUE or that an EF query is FALSE, but only if we can visit all the
+// reachable markings.
+type Explorer struct {
+	*Worker
+	DFS       bool // use a depth-first strategy instead of breadth-first
+	MaxStates int  // limit on the number of states we visit (0 means none)
+	Stats
+}
+
+// Stats gives information on the part of the state space visited by an
+// Explorer. Depth is the length of the longest path from the initial marking
+// in the exploration tree. Exhausted is true when we visited all the reachable
+// markings.
+type Stats struct {
+	States    int
+	Edges     int
+	Depth     int
+	Exhausted bool
+}
+
+func (st Stats) String() string {
+	s := fmt.Sprintf("%d state(s), %d edge(s), depth %d", st.States, st.Edges, st.Depth)
+	if !st.Exhausted {
+		s += " (incomplete)"
+	}
+	return s
+}
+
+// node is an element in the list of markings we still need to explore.
+type node struct {
+	m     pnml.Marking
+	depth int
+}
+
+// NewExplorer returns a fresh Explorer for the initial marking of s.
+func NewExplorer(s *Stepper) *Explorer {
+	return &Explorer{Worker: NewWorker(s)}
+}
+
+// Explore visits the state space of the net, starting from the initial marking,
+// and evaluates the queries on every state. It returns a slice of verdicts, one
+// for each query. We stop as soon as all the queries are decided. A query stays
+// UNDEF if we could not explore the whole state space (for instance because of
+// forbidden transitions or because we reached MaxStates) or if its formula
+// cannot be evaluated on one of the states we visited.
+func (e *Explorer) Explore(queries []formula.Query) []formula.Bool {
+	verdicts := make([]formula.Bool, len(queries))
+	undecided := len(queries)
+	// tainted[i] is true when we found a marking where the formula of query i
+	// evaluates to UNDEF. In this case we cannot give a verdict when the state
+	// space is exhausted.
+	tainted := make([]bool, len(queries))
+
+	e.Stats = Stats{}
+	e.restart()
+	visited := map[string]struct{}{e.COL.Key(): {}}
+	queue := []node{{m: e.COL, depth: 0}}
+
+	for len(queue) != 0 {
+		var n node
+		if e.DFS {
+			n, queue = queue[len(queue)-1], queue[:len(queue)-1]
+		} else {
+			n, queue = queue[0], queue[1:]
+		}
+		e.update(n.m)
+		e.States++
+		if n.depth > e.Depth {
+			e.Depth = n.depth
+		}
+
+		for i, q := range queries {
+			if verdicts[i] != formula.UNDEF {
+				continue
+			}
+			b, err := hasReached(e.PT, e.Enabled, q.Formula)
+			v, ok := b.Value()
+			if err != nil || !ok {
+				tainted[i] = true
+				continue
+			}
+			if q.IsEF && v {
+				verdicts[i] = formula.TRUE
+				undecided--
+			}
+			if !q.IsEF && !v {
+				verdicts[i] = formula.FALSE
+				undecided--
+			}
+		}
+
+		if len(queries) != 0 && undecided == 0 {
+			return verdicts
+		}
+
+		// We add the successors for every possible binding of the enabled
+		// transitions.
+		for k, t := range e.Trans {
+			if !e.Enabled[t.Name].IsTrue() {
+				continue
+			}
+			if _, ok := e.forbidFiring[k]; ok {
+				continue
+			}
+			bindings, err := e.Bindings(k)
+			if err != nil {
+				// we cannot enumerate all the successors of this marking
+				return verdicts
+			}
+			for _, b := range bindings {
+				e.Edges++
+				key := b.After.Key()
+				if _, ok := visited[key]; ok {
+					continue
+				}
+				if e.MaxStates != 0 && len(visited) >= e.MaxStates {
+					return verdicts
+				}
+				visited[key] = struct{}{}
+				queue = append(queue, node{m: b.After, depth: n.depth + 1})
+			}
+		}
+	}
+
+	// We visited all the reachable markings. The result is only exhaustive if
+	// we never stumbled on a transition that we cannot fire or for which we
+	// cannot decide enabledness.
+	if len(e.forbidFiring) != 0 || len(e.forbidEnabled) != 0 {
+		return verdicts
+	}
+	e.Exhausted = true
+	for i, q := range queries {
+		if verdicts[i] != formula.UNDEF || tainted[i] {
+			continue
+		}
+		// EF phi is false if phi is never true; AG phi is true if phi is
+		// never false
+		verdicts[i] = formula.From(!q.IsEF)
+	}
+	return verdicts
+}
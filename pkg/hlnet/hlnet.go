@@ -5,6 +5,7 @@ package hlnet
 
 import (
 	"fmt"
+	"io"
 	"sort"
 
 	"github.com/dalzilio/hue/pkg/pnml"
@@ -17,6 +18,10 @@ type Net struct {
 	Places    []*Place
 	TPosition map[string]int // gives the index of a transition in Trans
 	Trans     []*Transition
+	// Dependents gives, for each place, the index of the transitions with an
+	// input arc from this place. These are the only transitions whose
+	// enabledness can change when the marking of the place is modified.
+	Dependents [][]int
 }
 
 // Place is the concrete type of symmetric nets places.
@@ -67,10 +72,12 @@ func Build(n *pnml.Net) (*Net, error) {
 	net.Places = make([]*Place, len(pnames))
 	for _, p := range n.Page.Places {
 		var h pnml.Hue
-		if p.InitialMarking == nil {
-			h = pnml.Hue{}
-		} else {
-			h = p.InitialMarking.Eval(net.Net, nil)
+		if p.InitialMarking != nil {
+			m, err := p.InitialMarking.Eval(net.Net, nil)
+			if err != nil {
+				return nil, fmt.Errorf("initial marking of place %s: %w", p.ID, err)
+			}
+			h = m
 		}
 		net.Places[net.PPosition[p.ID]] = &Place{
 			Name: p.ID,
@@ -128,5 +135,61 @@ func Build(n *pnml.Net) (*Net, error) {
 		}
 	}
 
+	net.Dependents = make([][]int, len(net.Places))
+	for k, t := range net.Trans {
+		for _, a := range t.Ins {
+			if l := net.Dependents[a.Place]; len(l) == 0 || l[len(l)-1] != k {
+				net.Dependents[a.Place] = append(l, k)
+			}
+		}
+	}
+
 	return &net, nil
 }
+
+// ----------------------------------------------------------------------
+
+// PNML returns a PNML net equivalent to net. It shares its declarations with
+// the PNML net used to build net, but the page is computed from the places,
+// transitions and arcs of net. Initial markings are given as ground multisets,
+// so this can be used to save a net after we modified it.
+func (net *Net) PNML() *pnml.Net {
+	pn := *net.Net
+	pn.Page = pnml.Page{ID: net.Page.ID}
+	for _, p := range net.Places {
+		pn.Page.Places = append(pn.Page.Places, &pnml.Place{
+			ID:             p.Name,
+			Type:           pnml.Type{ID: p.Type},
+			InitialMarking: net.HueExpr(p.Init),
+		})
+	}
+	pattern := func(a *Arcs) pnml.Expression {
+		if len(a.Pattern) == 1 {
+			return a.Pattern[0]
+		}
+		return pnml.Add(a.Pattern)
+	}
+	for _, t := range net.Trans {
+		pn.Page.Trans = append(pn.Page.Trans, &pnml.Transition{ID: t.Name, Condition: t.Cond})
+		for _, a := range t.Ins {
+			pn.Page.Arcs = append(pn.Page.Arcs, &pnml.Arc{
+				Source:  net.Places[a.Place].Name,
+				Target:  t.Name,
+				Pattern: pattern(a),
+			})
+		}
+		for _, a := range t.Outs {
+			pn.Page.Arcs = append(pn.Page.Arcs, &pnml.Arc{
+				Source:  t.Name,
+				Target:  net.Places[a.Place].Name,
+				Pattern: pattern(a),
+			})
+		}
+	}
+	return &pn
+}
+
+// Encode writes net as a symmetric net PNML document on w.
+func (net *Net) Encode(w io.Writer) error {
+	return pnml.NewEncoder(w).Encode(net.PNML())
+}
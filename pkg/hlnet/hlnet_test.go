@@ -0,0 +1,423 @@
+package hlnet
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dalzilio/hue/pkg/formula"
+	"github.com/dalzilio/hue/pkg/pnml"
+)
+
+// loadNet returns the hlnet for the model.pnml file in the given benchmark
+// folder.
+func loadNet(t *testing.T, model string) *Net {
+	xmlFile, err := os.Open(filepath.Join("../../benchmarks", model, "model.pnml"))
+	if err != nil {
+		t.Fatalf("error opening file: %s", err)
+	}
+	defer xmlFile.Close()
+	return decodeNet(t, model, xmlFile)
+}
+
+// loadTestNet returns the hlnet for the file name.pnml in the testdata folder.
+func loadTestNet(t *testing.T, name string) *Net {
+	xmlFile, err := os.Open(filepath.Join("testdata", name+".pnml"))
+	if err != nil {
+		t.Fatalf("error opening file: %s", err)
+	}
+	defer xmlFile.Close()
+	return decodeNet(t, name, xmlFile)
+}
+
+// decodeNet returns the hlnet for the PNML net read from r.
+func decodeNet(t *testing.T, model string, r io.Reader) *Net {
+	decoder := pnml.NewDecoder(r)
+	var p = new(pnml.Net)
+	if err := decoder.Build(p); err != nil {
+		t.Fatalf("error decoding PNML file %s: %s", model, err)
+	}
+	hl, err := Build(p)
+	if err != nil {
+		t.Fatalf("error building hlnet for %s: %s", model, err)
+	}
+	return hl
+}
+
+func TestExplore(t *testing.T) {
+	// number of reachable states, as reported on the MCC website
+	expected := map[string]int{
+		"Philosophers-COL-000005":    243,
+		"SharedMemory-COL-000005":    1863,
+		"TokenRing-COL-005":          166,
+		"DatabaseWithMutex-COL-02":   153,
+		"PhilosophersDyn-COL-03":     325,
+		"QuasiCertifProtocol-COL-02": 1029,
+	}
+	for model, states := range expected {
+		x := NewExplorer(NewStepper(loadNet(t, model), 0))
+		x.Explore(nil)
+		if !x.Exhausted {
+			t.Errorf("Explore(): exploration of model %s is not exhaustive", model)
+		}
+		if x.States != states {
+			t.Errorf("Explore(): model %s has not the right number of states (has %d instead of %d)", model, x.States, states)
+		}
+	}
+}
+
+// testdataStats gives the number of reachable states and edges of the nets in
+// the testdata folder. We leave out net integers-mult, that has a forbidden
+// transition and cannot be fully explored.
+var testdataStats = map[string]struct{ states, edges int }{
+	"integers":        {4, 5},
+	"booleans":        {4, 5},
+	"multisets":       {2, 1},
+	"partitions":      {3, 2},
+	"successors":      {3, 3},
+	"successors-zero": {4, 3},
+	"undefined":       {1, 0},
+	"nested":          {4, 6},
+}
+
+func TestExploreTestdata(t *testing.T) {
+	for name, want := range testdataStats {
+		x := NewExplorer(NewStepper(loadTestNet(t, name), 0))
+		x.Explore(nil)
+		if !x.Exhausted {
+			t.Errorf("Explore(): exploration of net %s is not exhaustive", name)
+		}
+		if x.States != want.states || x.Edges != want.edges {
+			t.Errorf("Explore(): net %s should have %d states and %d edges, not %s", name, want.states, want.edges, x.Stats)
+		}
+	}
+}
+
+func TestFireBinding(t *testing.T) {
+	w := NewWorker(NewStepper(loadNet(t, "Philosophers-COL-000005"), 0))
+	for k, tr := range w.Trans {
+		bindings, err := w.Bindings(k)
+		if err != nil {
+			t.Fatalf("Bindings(): unexpected error on transition %s: %s", tr.Name, err)
+		}
+		for _, b := range bindings {
+			w.restart()
+			w.computeEnabled()
+			if err := w.FireBinding(k, b.Env); err != nil {
+				t.Errorf("FireBinding(): error on transition %s: %s", tr.Name, err)
+				continue
+			}
+			if w.COL.Key() != b.After.Key() {
+				t.Errorf("FireBinding(): transition %s %s does not lead to the expected marking", tr.Name, w.PrintVEnv(b.Env))
+			}
+		}
+		w.restart()
+		w.computeEnabled()
+	}
+	// transition End is not enabled in the initial marking
+	k := w.TPosition["End"]
+	venv := pnml.VEnv{}
+	for _, v := range w.Trans[k].Env {
+		venv[v] = w.World[w.TypeEnvt[v]][0]
+	}
+	err := w.FireBinding(k, venv)
+	if _, ok := err.(*NotEnabledError); !ok {
+		t.Errorf("FireBinding(): expected a NotEnabledError when firing End, got %v", err)
+	}
+}
+
+func TestFireWitness(t *testing.T) {
+	// the second worker gets the witnesses in After from the initial marking
+	// computed by the first one, but the binding recorded when firing a
+	// transition should still be valid
+	s := NewStepper(loadNet(t, "Philosophers-COL-000005"), 0)
+	NewWorker(s)
+	for k, tr := range s.Trans {
+		w := NewWorker(s)
+		if !w.Enabled[tr.Name].IsTrue() {
+			continue
+		}
+		w.Fire(k, false)
+		st := w.Trace().Steps
+		if len(st) != 1 || len(st[0].Env) != len(tr.Env) {
+			t.Fatalf("Fire(): wrong trace after firing transition %s", tr.Name)
+		}
+		r := NewWorker(s)
+		if err := r.FireBinding(k, st[0].Env); err != nil {
+			t.Errorf("FireBinding(): cannot replay transition %s %s: %s", tr.Name, w.PrintVEnv(st[0].Env), err)
+			continue
+		}
+		if r.COL.Key() != w.COL.Key() {
+			t.Errorf("FireBinding(): transition %s %s does not lead to the expected marking", tr.Name, w.PrintVEnv(st[0].Env))
+		}
+	}
+}
+
+func TestIncrementalUpdate(t *testing.T) {
+	// after each step of a random walk, the enabledness relation and the
+	// witnesses updated incrementally should be the same than the ones
+	// computed from scratch on the current marking
+	models := []string{
+		"Philosophers-COL-000005",
+		"SharedMemory-COL-000005",
+		"TokenRing-COL-005",
+		"DatabaseWithMutex-COL-02",
+		"PhilosophersDyn-COL-03",
+		"QuasiCertifProtocol-COL-02",
+	}
+	for _, model := range models {
+		s := NewStepper(loadNet(t, model), 1)
+		w := NewWorker(s)
+		r := NewWorker(s)
+	walk:
+		for i := 0; i < 300; i++ {
+			w.FireAtRandom(false)
+			r.State = w.State.Clone()
+			r.Enabled = make(map[string]formula.Bool)
+			r.computeEnabled()
+			for k, tr := range w.Trans {
+				if w.Enabled[tr.Name] != r.Enabled[tr.Name] {
+					t.Errorf("model %s, step %d: transition %s is %s but should be %s", model, i, tr.Name, w.Enabled[tr.Name], r.Enabled[tr.Name])
+					break walk
+				}
+				if w.After[k].Key() != r.After[k].Key() {
+					t.Errorf("model %s, step %d: wrong marking after transition %s", model, i, tr.Name)
+					break walk
+				}
+			}
+		}
+	}
+}
+
+func TestFreeVariables(t *testing.T) {
+	// variables that do not appear in the input arcs can take any value in
+	// their type.
+	tests := []struct {
+		model, trans, variable string
+		bindings               int
+	}{
+		// variable in the output arcs only
+		{"DatabaseWithMutex-COL-02", "Start", "varf", 4},
+		// variable in the condition only
+		{"VehicularWifi-COL-none", "PacketArrival", "sb", 8},
+	}
+	for _, tt := range tests {
+		w := NewWorker(NewStepper(loadNet(t, tt.model), 0))
+		k := w.TPosition[tt.trans]
+		if _, ok := w.forbidFiring[k]; ok {
+			t.Fatalf("transition %s should be fireable", tt.trans)
+		}
+		bindings, err := w.Bindings(k)
+		if err != nil {
+			t.Fatalf("Bindings(): unexpected error on transition %s: %s", tt.trans, err)
+		}
+		if len(bindings) != tt.bindings {
+			t.Errorf("Bindings(): transition %s should have %d bindings, not %d", tt.trans, tt.bindings, len(bindings))
+		}
+		for _, b := range bindings {
+			if b.Env[tt.variable] == nil {
+				t.Errorf("Bindings(): variable %s is not bound in %s", tt.variable, w.PrintVEnv(b.Env))
+			}
+		}
+	}
+}
+
+func TestIntegers(t *testing.T) {
+	hl := loadTestNet(t, "integers")
+	// from the marking 3, transition dec should bind x to 1
+	w := NewWorker(NewStepper(hl, 0))
+	for i := 0; i < 3; i++ {
+		if err := w.FireBinding(w.TPosition["inc"], pnml.VEnv{"x": w.IntValue(i)}); err != nil {
+			t.Fatalf("FireBinding(): %s", err)
+		}
+	}
+	bindings, err := w.Bindings(w.TPosition["dec"])
+	if err != nil || len(bindings) != 1 {
+		t.Fatalf("Bindings(): transition dec should have one binding (%v)", err)
+	}
+	if n, _ := w.IntOf(bindings[0].Env["x"]); n != 1 {
+		t.Errorf("Bindings(): transition dec should bind x to 1, not %s", w.PrintVEnv(bindings[0].Env))
+	}
+	if w.Enabled["inc"].IsTrue() {
+		t.Errorf("transition inc should not be enabled when the token is 3")
+	}
+}
+
+func TestBooleans(t *testing.T) {
+	hl := loadTestNet(t, "booleans")
+	for _, b := range []string{"true", "false"} {
+		if v, err := hl.ParseValue(b); err != nil || hl.PrintValue(v) != b {
+			t.Errorf("ParseValue(): cannot parse boolean %s (%v)", b, err)
+		}
+	}
+	for _, b := range []string{"t", "F", "TRUE"} {
+		if _, err := hl.ParseValue(b); err == nil {
+			t.Errorf("ParseValue(): %s should not be accepted as a boolean", b)
+		}
+	}
+}
+
+func TestMultisetOperators(t *testing.T) {
+	hl := loadTestNet(t, "multisets")
+	w := NewWorker(NewStepper(hl, 0))
+	bindings, err := w.Bindings(w.TPosition["t"])
+	if err != nil || len(bindings) != 1 {
+		t.Fatalf("Bindings(): transition t should have one binding (%v)", err)
+	}
+	if s := w.PrintVEnv(bindings[0].Env); s != "(x : a)" {
+		t.Errorf("Bindings(): transition t should bind x to a, not %s", s)
+	}
+	if s := w.PrintHue(bindings[0].After[0]); s != "2'a" {
+		t.Errorf("Bindings(): firing t should lead to marking 2'a, not %s", s)
+	}
+}
+
+func TestPartitions(t *testing.T) {
+	hl := loadTestNet(t, "partitions")
+	if p := hl.Declaration.Partitions; len(p) != 1 || p[0].Type.ID != "C" {
+		t.Fatalf("Build(): partition P should be a partition of sort C")
+	}
+	w := NewWorker(NewStepper(hl, 0))
+	bindings, err := w.Bindings(w.TPosition["t"])
+	if err != nil || len(bindings) != 1 {
+		t.Fatalf("Bindings(): transition t should have one binding (%v)", err)
+	}
+	if s := w.PrintVEnv(bindings[0].Env); s != "(x : c1, y : c3)" {
+		t.Errorf("Bindings(): transition t should bind x to c1 and y to c3, not %s", s)
+	}
+	bindings, err = w.Bindings(w.TPosition["u"])
+	if err != nil || len(bindings) != 1 {
+		t.Fatalf("Bindings(): transition u should have one binding (%v)", err)
+	}
+	if s := w.PrintVEnv(bindings[0].Env); s != "(x : c1)" {
+		t.Errorf("Bindings(): transition u should bind x to c1, not %s", s)
+	}
+}
+
+func TestSuccessors(t *testing.T) {
+	hl := loadTestNet(t, "successors")
+	// we reach the marking c by firing t twice, after which t is not enabled
+	// since the successor of c is undefined
+	w := NewWorker(NewStepper(hl, 0))
+	k := w.TPosition["t"]
+	for _, c := range []string{"a", "b"} {
+		v, _ := w.ParseValue(c)
+		if err := w.FireBinding(k, pnml.VEnv{"x": v}); err != nil {
+			t.Fatalf("FireBinding(): %s", err)
+		}
+	}
+	v, _ := w.ParseValue("c")
+	err := w.FireBinding(k, pnml.VEnv{"x": v})
+	if _, ok := err.(*NotEnabledError); !ok {
+		t.Errorf("FireBinding(): expected a NotEnabledError when firing t with x=c, got %v", err)
+	}
+	if s := w.PrintHue(w.COL[0]); s != "1'c" {
+		t.Errorf("FireBinding(): marking should be unchanged, not %s", s)
+	}
+
+	// an output pattern with a null multiplicity is defined, so u is enabled
+	// in the marking b even if it produces no token
+	w = NewWorker(NewStepper(loadTestNet(t, "successors-zero"), 0))
+	v, _ = w.ParseValue("a")
+	if err := w.FireBinding(w.TPosition["t"], pnml.VEnv{"x": v}); err != nil {
+		t.Fatalf("FireBinding(): %s", err)
+	}
+	if !w.Enabled["u"].IsTrue() {
+		t.Errorf("transition u should be enabled in marking %s", w.PrintHue(w.COL[0]))
+	}
+}
+
+func TestUndefinedInput(t *testing.T) {
+	// the input pattern x++1 is ground once x is bound to b, but undefined, so
+	// that it matches no token in Q
+	w := NewWorker(NewStepper(loadTestNet(t, "undefined"), 0))
+	k := w.TPosition["t"]
+	if w.Enabled["t"].IsTrue() {
+		t.Errorf("transition t should not be enabled in the initial marking")
+	}
+	bindings, err := w.Bindings(k)
+	if err != nil || len(bindings) != 0 {
+		t.Errorf("Bindings(): transition t should have no binding, not %d (%v)", len(bindings), err)
+	}
+	v, _ := w.ParseValue("b")
+	err = w.FireBinding(k, pnml.VEnv{"x": v})
+	if _, ok := err.(*NotEnabledError); !ok {
+		t.Errorf("FireBinding(): expected a NotEnabledError when firing t with x=b, got %v", err)
+	}
+}
+
+func TestNestedSorts(t *testing.T) {
+	hl := loadTestNet(t, "nested")
+	if n := len(hl.World["A"]); n != 2 {
+		t.Errorf("pnml.Build(): alias A should have 2 values, not %d", n)
+	}
+	if n := len(hl.World["N"]); n != 8 {
+		t.Errorf("pnml.Build(): sort N should have 8 values, not %d", n)
+	}
+	w := NewWorker(NewStepper(hl, 0))
+	bindings, err := w.Bindings(w.TPosition["t"])
+	if err != nil || len(bindings) != 1 {
+		t.Fatalf("Bindings(): transition t should have one binding (%v)", err)
+	}
+	if s := w.PrintVEnv(bindings[0].Env); s != "(x : a, y : (a, b))" {
+		t.Errorf("Bindings(): transition t should bind x to a and y to (a, b), not %s", s)
+	}
+}
+
+func TestEncode(t *testing.T) {
+	nets := map[string]*Net{
+		"Philosophers-COL-000005": loadNet(t, "Philosophers-COL-000005"),
+		"PhilosophersDyn-COL-03":  loadNet(t, "PhilosophersDyn-COL-03"),
+	}
+	for name := range testdataStats {
+		nets[name] = loadTestNet(t, name)
+	}
+	for name, hl := range nets {
+		var b bytes.Buffer
+		if err := hl.Encode(&b); err != nil {
+			t.Errorf("Encode(): error encoding %s: %s", name, err)
+			continue
+		}
+		hl2 := decodeNet(t, name, &b)
+		x1 := NewExplorer(NewStepper(hl, 0))
+		x1.Explore(nil)
+		x2 := NewExplorer(NewStepper(hl2, 0))
+		x2.Explore(nil)
+		if x1.Stats != x2.Stats {
+			t.Errorf("Encode(): net %s has %s, but its encoding has %s", name, x1.Stats, x2.Stats)
+		}
+	}
+}
+
+func TestDiagnose(t *testing.T) {
+	tests := []struct {
+		name  string
+		hl    *Net
+		kinds []string
+	}{
+		{"integers", loadTestNet(t, "integers"), nil},
+		{"integers-mult", loadTestNet(t, "integers-mult"), []string{FeatureGroundOnly, FeatureForbidEnabled}},
+		{"multisets", loadTestNet(t, "multisets"), []string{FeatureAllInput}},
+		{"partitions", loadTestNet(t, "partitions"), []string{FeaturePartition, FeaturePartitionOf, FeaturePartitionOf, FeaturePartitionOf}},
+	}
+	for _, tt := range tests {
+		r := Diagnose(tt.hl, 10, 0)
+		if len(r.Features) != len(tt.kinds) {
+			t.Errorf("Diagnose(): net %s should have %d features, not %s", tt.name, len(tt.kinds), r)
+			continue
+		}
+		for i, k := range tt.kinds {
+			if r.Features[i].Kind != k {
+				t.Errorf("Diagnose(): feature %d of net %s should be %s, not %s", i, tt.name, k, r.Features[i].Kind)
+			}
+		}
+	}
+
+	r := Diagnose(loadTestNet(t, "integers-mult"), 0, 0)
+	if r.Sorts[0].Card != -1 || !strings.Contains(r.Features[1].Detail, "unsupported feature") {
+		t.Errorf("Diagnose(): sort int should be infinite and dec unsupported, not %s", r)
+	}
+}
@@ -5,6 +5,7 @@
 package hlnet
 
 import (
+	"errors"
 	"fmt"
 	"sort"
 
@@ -17,12 +18,17 @@ import (
 // marking of places).
 type Iterator struct {
 	*Net
-	tid            int            // index of the transition in the net
-	idx            int            // index of the arc we are currently iterating
-	pnml.Operation                // condition associated with the transition
-	checkpoints    []pnml.Env     // keep track of which variable to update when backtracking
-	venv           pnml.VEnv      // current environment
-	arcs           []*arcIterator // sub-iterator for each input place
+	tid            int               // index of the transition in the net
+	idx            int               // index of the arc we are currently iterating
+	pnml.Operation                   // condition associated with the transition
+	checkpoints    []pnml.Env        // keep track of which variable to update when backtracking
+	venv           pnml.VEnv         // current environment
+	arcs           []*arcIterator    // sub-iterator for each input place
+	msets          []*msetArc        // multiset patterns in the input arcs
+	outs           []pnml.Expression // patterns in the output arcs
+	free           pnml.Env          // variables not appearing in the input arcs
+	domains        [][]*pnml.Value   // possible values for each free variable
+	fpos           []int             // current position in the domain of each free variable
 }
 
 type arcIterator struct {
@@ -35,6 +41,15 @@ type arcIterator struct {
 	mults          []int             // current multiplicities
 }
 
+// msetArc is used for the patterns of an input arc that cannot be unified with
+// a single token, like <all> or <subtract>. They are evaluated as a multiset
+// once all the variables are bound, and we check that the result is included
+// in the marking of place pl.
+type msetArc struct {
+	pl  int               // index of the related place in the net
+	pre []pnml.Expression // multiset patterns related to place pl
+}
+
 // ----------------------------------------------------------------------
 
 // newIterator initializes a slice of Iterators for transition with index k in
@@ -54,35 +69,54 @@ func (s *Stepper) newIterator(k int) *Iterator {
 	insEnv := pnml.Env{}
 
 	for _, a := range s.Trans[k].Ins {
-		pats = append(pats, a.Pattern)
+		tokens, msets := splitPatterns(a.Pattern)
+		if len(msets) != 0 {
+			iter.msets = append(iter.msets, &msetArc{pl: a.Place, pre: msets})
+		}
+		if len(tokens) == 0 {
+			continue
+		}
+		pats = append(pats, tokens)
 		pls = append(pls, a.Place)
-		extra := insEnv.Extra(a.Env)
+		env := pnml.Env{}
+		for _, p := range tokens {
+			env = p.AddEnv(env)
+		}
+		extra := insEnv.Extra(env)
 		iter.checkpoints = append(iter.checkpoints, extra)
 		insEnv = append(insEnv, extra...)
 	}
 
-	// We test that all the variables in the condition are in the input arcs;
-	// otherwise we may miss constraints during unification and cannot decide if
-	// a transition is enabled. This is the case with model PhilosopherDyn for
-	// example. We also have the case where there are variables in the out arcs
-	// not appearing in the inputs. They should be associated with an <all> on
-	// all the values with the type of the place. The only knwown case is
-	// DatabaseWithMutex.
-	if !util.StringListIncludes(insEnv, s.Trans[k].Cond.AddEnv(nil)) {
-		s.forbidFiring[k] = struct{}{}
-		s.forbidEnabled[k] = struct{}{}
-		s.forbidden[s.Trans[k].Name] = struct{}{}
-		return iter
+	// We may have variables in the condition, in the out arcs, or in multiset
+	// patterns, that do not appear in the input arcs (see PhilosophersDyn and
+	// DatabaseWithMutex). These free variables can take any value in their
+	// type, so we enumerate all the values in the World after we matched the
+	// input arcs, and before checking the condition.
+	iter.free = insEnv.Extra(s.Trans[k].Env)
+	iter.domains = make([][]*pnml.Value, len(iter.free))
+	iter.fpos = make([]int, len(iter.free))
+	for i, v := range iter.free {
+		dom, ok := s.World[s.TypeEnvt[v]]
+		if !ok {
+			// we cannot enumerate the values of infinite sorts, like
+			// integers
+			s.forbidFiring[k] = struct{}{}
+			s.forbidEnabled[k] = struct{}{}
+			s.forbidden[s.Trans[k].Name] = pnml.Unsupported("free variable %s of infinite sort %s in transition %s", v, s.TypeEnvt[v], s.Trans[k].Name)
+			return iter
+		}
+		iter.domains[i] = dom
 	}
 
-	iter.venv = pnml.NewVEnv(insEnv)
-
-	// If we have extra variables, we must prevent the stepper from firing this
-	// transition. But we may may still want to test if it is enabled.
-	if len(s.Trans[k].Env) > len(insEnv) {
-		s.forbidFiring[k] = struct{}{}
+	// The patterns in the output arcs may be undefined for some bindings,
+	// like the successor of the last constant in a finite enumeration. We
+	// need to check them before accepting a match.
+	for _, a := range s.Trans[k].Outs {
+		iter.outs = append(iter.outs, a.Pattern...)
 	}
 
+	iter.venv = pnml.NewVEnv(s.Trans[k].Env)
+
 	iter.arcs = make([]*arcIterator, len(pls))
 	insEnv = pnml.Env{}
 	for i := range pls {
@@ -112,7 +146,6 @@ func (iter *Iterator) Environment() pnml.VEnv {
 
 // reset is used when we need to iterate over a new marking.
 func (w *Worker) reset(k int) {
-	w.After[k] = nil
 	w.iter[k].idx = 0
 	w.iter[k].venv.ResetAll()
 	for _, a := range w.iter[k].arcs {
@@ -123,6 +156,9 @@ func (w *Worker) reset(k int) {
 			a.mults[j] = 0
 		}
 	}
+	for i := range w.iter[k].fpos {
+		w.iter[k].fpos[i] = 0
+	}
 }
 
 // ----------------------------------------------------------------------
@@ -177,22 +213,38 @@ func (w *Worker) stepCurrentPlace(k int) bool {
 
 // ----------------------------------------------------------------------
 
-// check computes the next possible assignment (VEnv) that matches all the arc
+// check computes the first possible assignment (VEnv) that matches all the arc
 // patterns and also the condition (Operation). It returns false if we do not
 // find a witness. It can also return an error if we find a problem while
 // unifying an arc pattern (for instance if the arc contains an <All>
 // expression, like with model DatabaseWithMutex).
 func (w *Worker) check(k int) (bool, error) {
-	it := w.iter[k]
+	w.After[k] = nil
 	w.reset(k)
 
 	// There is nothing to match if one of the input place marking is empty
-	for _, a := range it.arcs {
+	for _, a := range w.iter[k].arcs {
 		if len(w.COL[a.pl]) == 0 {
 			return false, nil
 		}
 	}
 
+	ok, err := w.search(k)
+	if ok {
+		// we should not compute the result of forbidden transitions
+		if _, forbid := w.forbidFiring[k]; !forbid {
+			w.After[k], err = w.getWitness(k)
+		}
+	}
+	return ok, err
+}
+
+// search computes the next possible assignment, starting from the current
+// position of the iterator for transition k. We use it to find the first match
+// (after a reset) but also to enumerate all the possible matches (after a
+// call to next).
+func (w *Worker) search(k int) (bool, error) {
+	it := w.iter[k]
 	for {
 		// if it.idx < len(it.arcs) {
 		// 	fmt.Printf("-[%s(place %s) with %s\n", s.Trans[k].Name, s.Places[it.arcs[it.idx].pl].Name, it.PrintVEnv(s.Net))
@@ -200,22 +252,26 @@ func (w *Worker) check(k int) (bool, error) {
 		// 	fmt.Printf("--[testing %s with %s\n", s.Trans[k].Name, it.PrintVEnv(s.Net))
 		// }
 		if it.idx == len(it.arcs) {
-			// We have a potential match. We need to check that it is a solution
-			// for the condition in the transition
-			if it.Operation.OK(w.Net.Net, it.venv) {
-				// we should not compute the result of forbidden transitions
-				if _, ok := w.forbidFiring[k]; !ok {
-					w.After[k] = w.getWitness(k)
-				}
+			// We have a potential match, once we give a value to the free
+			// variables. We need to check that it is a solution for the
+			// condition in the transition
+			if !it.bindFree() {
+				return false, nil
+			}
+			ok, err := w.accept(k)
+			if err != nil {
+				return false, err
+			}
+			if ok {
 				return true, nil
 			}
 
 			// It is not a match, we need to start iterating to the next
 			// potential candidate
-			w.iter[k].idx--
-			if !w.step(k) {
+			if !w.next(k) {
 				return false, nil
 			}
+			continue
 		}
 
 		b, err := w.checkCurrentPlace(k)
@@ -235,6 +291,49 @@ func (w *Worker) check(k int) (bool, error) {
 	}
 }
 
+// next moves the iterator for transition k past the current (complete) match.
+// We first try the next values for the free variables, if any, and only
+// backtrack in the input arcs after we tried all of them. It returns false if
+// there are no more choices. This is always the case for transitions without
+// input arcs and free variables, that have at most one match.
+func (w *Worker) next(k int) bool {
+	if w.iter[k].stepFree() {
+		return true
+	}
+	if len(w.iter[k].arcs) == 0 {
+		return false
+	}
+	w.iter[k].idx--
+	return w.step(k)
+}
+
+// bindFree updates the environment with the values of the free variables at
+// the current position. It returns false if one of the variables has an empty
+// domain, in which case there are no matches.
+func (iter *Iterator) bindFree() bool {
+	for i, v := range iter.free {
+		if len(iter.domains[i]) == 0 {
+			return false
+		}
+		iter.venv[v] = iter.domains[i][iter.fpos[i]]
+	}
+	return true
+}
+
+// stepFree moves to the next possible values for the free variables, like with
+// an odometer. It returns false, and goes back to the first values, when we
+// tried all the possible combinations.
+func (iter *Iterator) stepFree() bool {
+	for i := len(iter.fpos) - 1; i >= 0; i-- {
+		if iter.fpos[i] < len(iter.domains[i])-1 {
+			iter.fpos[i]++
+			return true
+		}
+		iter.fpos[i] = 0
+	}
+	return false
+}
+
 // checkCurrentPlace computes the next possible assignment for the patterns
 // associated with arc[idx] of transition[k]. We return false if there are no
 // match.
@@ -277,9 +376,116 @@ func (w *Worker) checkCurrentPlace(k int) (bool, error) {
 	}
 }
 
+// accept tests if the current (complete) binding of transition k is a match.
+// It should satisfy the condition of the transition, the multiset patterns on
+// its input arcs, and the output patterns should be defined.
+func (w *Worker) accept(k int) (bool, error) {
+	it := w.iter[k]
+	ok, err := it.Operation.OK(w.Net.Net, it.venv)
+	if err != nil || !ok {
+		return false, err
+	}
+	ok, err = w.checkMultisets(k)
+	if err != nil || !ok {
+		return false, err
+	}
+	return it.checkOutputs()
+}
+
+// checkMultisets tests if the multiset patterns of transition k, evaluated
+// with the current environment, are included in the marking. We take into
+// account the tokens already matched by the other patterns on the same place.
+func (w *Worker) checkMultisets(k int) (bool, error) {
+	it := w.iter[k]
+	for _, m := range it.msets {
+		var atoms []pnml.Atom
+		for _, a := range it.arcs {
+			if a.pl != m.pl {
+				continue
+			}
+			for j, p := range a.pos {
+				atoms = append(atoms, pnml.Atom{Value: w.COL[m.pl][p].Value, Mult: a.mults[j]})
+			}
+		}
+		for _, e := range m.pre {
+			mset, err := e.Eval(w.Net.Net, it.venv)
+			if errors.Is(err, pnml.ErrUndefined) {
+				return false, nil
+			}
+			if err != nil {
+				return false, err
+			}
+			atoms = append(atoms, mset...)
+		}
+		if !w.COL[m.pl].Includes(pnml.NewMultiset(atoms)) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// checkOutputs tests if the token patterns in the output arcs are defined for
+// the current environment, meaning that their evaluation does not return
+// ErrUndefined. An empty result, like with 0'x, is a valid output.
+func (iter *Iterator) checkOutputs() (bool, error) {
+	for _, e := range iter.outs {
+		_, err := e.Eval(iter.Net.Net, iter.venv)
+		if errors.Is(err, pnml.ErrUndefined) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// splitPatterns separates the patterns that can be unified with a single token
+// from the ones that should be evaluated as a multiset. Nested <add> are
+// flattened (see VehicularWifi).
+func splitPatterns(pats []pnml.Expression) (tokens, msets []pnml.Expression) {
+	for _, p := range pats {
+		if add, ok := p.(pnml.Add); ok {
+			t, m := splitPatterns(add)
+			tokens = append(tokens, t...)
+			msets = append(msets, m...)
+			continue
+		}
+		if isMultisetPattern(p) {
+			msets = append(msets, p)
+		} else {
+			tokens = append(tokens, p)
+		}
+	}
+	return tokens, msets
+}
+
+// isMultisetPattern reports whether an expression denotes a multiset that can
+// have more than one value, like an <all> or a <subtract> expression.
+func isMultisetPattern(e pnml.Expression) bool {
+	switch e := e.(type) {
+	case pnml.All, pnml.Subtract, pnml.Add:
+		return true
+	case pnml.Numberof:
+		return isMultisetPattern(e.Expression)
+	case pnml.ScalarProduct:
+		// we can only unify a scalar product when its multiplicity does not
+		// depend on a variable
+		return len(e.Mult.AddEnv(nil)) != 0 || isMultisetPattern(e.Expression)
+	default:
+		return false
+	}
+}
+
 func (iter *Iterator) PrintVEnv(net *Net) string {
+	return net.PrintVEnv(iter.venv)
+}
+
+// PrintVEnv returns a readable description of an association between variables
+// and values, sorted by variable names.
+func (net *Net) PrintVEnv(venv pnml.VEnv) string {
 	res := []string{}
-	for vname, val := range iter.Environment() {
+	for vname, val := range venv {
 		res = append(res, fmt.Sprintf("%s : %s", vname, net.PrintValue(val)))
 	}
 	sort.Strings(res)
@@ -18,12 +18,13 @@ import (
 type Stepper struct {
 	steppermut sync.Mutex // to protect for concurrent access when we need to copy m0 or update forbidEnabled
 	*Net
-	m0            *State              // initial state
-	lpn           int                 // length of the longest place name, for pretty printing markings
-	forbidFiring  map[int]struct{}    // index of transitions we should never fire
-	forbidEnabled map[int]struct{}    // index of transitions for which we cannot decide enabledness
-	forbidden     map[string]struct{} // name of transitions in forbidEnabled
-
+	m0            *State           // initial state
+	lpn           int              // length of the longest place name, for pretty printing markings
+	forbidFiring  map[int]struct{} // index of transitions we should never fire
+	forbidEnabled map[int]struct{} // index of transitions for which we cannot decide enabledness
+	forbidden     map[string]error // name of transitions in forbidEnabled, with the reason why
+	seed          int64            // master seed used to derive the seed of each worker
+	nworkers      int              // number of workers created from this stepper
 }
 
 // Worker includes a Stepper, a list of iterators used for checking that
@@ -31,12 +32,18 @@ type Stepper struct {
 // avoid concurrent writes) and a current state.
 type Worker struct {
 	*Stepper
-	iter []*Iterator // we keep iterators for each transitions in the net
+	iter  []*Iterator // we keep iterators for each transitions in the net
+	trace []Step      // transitions fired since the last restart
+	rand  *rand.Rand  // source of randomness used in FireAtRandom
+	dirty []bool      // transitions that should be checked again after an update
 	*State
 }
 
-// NewStepper returns a fresh Stepper starting with the initial marking of n
-func NewStepper(n *Net) *Stepper {
+// NewStepper returns a fresh Stepper starting with the initial marking of n.
+// Parameter seed is used to initialize the random generator of each worker
+// created from this Stepper. Two sequences of workers created with the same
+// seed will make the same choices in FireAtRandom.
+func NewStepper(n *Net, seed int64) *Stepper {
 	m0 := State{
 		COL:     make(pnml.Marking, len(n.Places)),
 		PT:      make(map[string]int),
@@ -48,7 +55,7 @@ func NewStepper(n *Net) *Stepper {
 
 	for k, v := range n.Places {
 		m0.COL[k] = v.Init
-		m0.PT[v.Name] = m0.COL[k].Sum()
+		m0.PT[v.Name] = v.Init.Card()
 		if len(v.Name) > lpn {
 			lpn = len(v.Name)
 		}
@@ -60,29 +67,47 @@ func NewStepper(n *Net) *Stepper {
 		lpn:           lpn,
 		forbidFiring:  make(map[int]struct{}),
 		forbidEnabled: make(map[int]struct{}),
-		forbidden:     make(map[string]struct{}),
+		forbidden:     make(map[string]error),
+		seed:          seed,
 	}
 
 	return &s
 }
 
-// NewWorker returns a fresh Worker initialized with m0
+// Forbidden returns the reason why we cannot decide if transition tname is
+// enabled, or nil if there is no such problem (yet). The result is an
+// UnsupportedError when the transition uses a construct we do not handle.
+func (s *Stepper) Forbidden(tname string) error {
+	s.steppermut.Lock()
+	defer s.steppermut.Unlock()
+	return s.forbidden[tname]
+}
+
+// NewWorker returns a fresh Worker initialized with m0. The seed of the worker
+// depends on the seed of the Stepper and on the number of workers created
+// before.
 func NewWorker(s *Stepper) *Worker {
 	w := Worker{Stepper: s}
 	w.iter = make([]*Iterator, len(s.Trans))
+	w.dirty = make([]bool, len(s.Trans))
 	s.steppermut.Lock()
+	w.rand = rand.New(rand.NewSource(s.seed + int64(s.nworkers)))
+	s.nworkers++
 	for k := range s.Trans {
 		w.iter[k] = s.newIterator(k)
 	}
 	w.State = w.m0.Clone()
-	// if we never computed the enabledness relation before
-	if w.m0.Enabled == nil {
+	s.steppermut.Unlock()
+	// if we never computed the enabledness relation before. We cannot hold the
+	// lock during computeEnabled, since it may need to update forbidEnabled.
+	if w.Enabled == nil {
 		w.Enabled = make(map[string]formula.Bool)
 		w.computeEnabled()
+		// we copy the result back to m0 for later use
+		s.steppermut.Lock()
+		w.m0 = w.State.Clone()
+		s.steppermut.Unlock()
 	}
-	// we copy the result back to m0 for later use
-	w.m0 = w.State.Clone()
-	s.steppermut.Unlock()
 	return &w
 }
 
@@ -93,11 +118,12 @@ func (w *Worker) Initialize() {
 	w.steppermut.Lock()
 	if w.m0.Enabled != nil {
 		w.State = w.m0.Clone()
-	} else {
-		w.Enabled = make(map[string]formula.Bool)
-		w.computeEnabled()
+		w.steppermut.Unlock()
+		return
 	}
 	w.steppermut.Unlock()
+	w.Enabled = make(map[string]formula.Bool)
+	w.computeEnabled()
 }
 
 func (w *Worker) String() string {
@@ -127,35 +153,70 @@ func (w *Worker) PrintCOLShort(m pnml.Marking) string {
 	return util.ZipString(res, "[", "]", ", ")
 }
 
-// Enabled returns the set of transitions which are enabled at the current
-// marking. As a side effect, it also add a list of witnesses in w for each of
-// the enabled transitions.
+// computeEnabled computes the set of transitions which are enabled at the
+// current marking. As a side effect, it also add a list of witnesses in w for
+// each of the enabled transitions. We use updateEnabled when we only need to
+// update the transitions whose input places have been modified.
 func (w *Worker) computeEnabled() {
-	// We could be more clever and only update the transition whose input places
-	// have been modified.
 	for tname := range w.TPosition {
 		w.Enabled[tname] = formula.FALSE
 	}
 	for tname := range w.forbidden {
 		w.Enabled[tname] = formula.UNDEF
 	}
-	for k, t := range w.Trans {
-		if _, ok := w.forbidEnabled[k]; ok {
+	for k := range w.Trans {
+		w.checkEnabled(k)
+	}
+}
+
+// checkEnabled updates the enabledness status of transition k, and its witness
+// in After, for the current marking.
+func (w *Worker) checkEnabled(k int) {
+	t := w.Trans[k]
+	if _, ok := w.forbidEnabled[k]; ok {
+		w.Enabled[t.Name] = formula.UNDEF
+		return
+	}
+	ok, err := w.check(k)
+	if err != nil {
+		// BEWARE!!: possible concurrent write to Stepper
+		w.steppermut.Lock()
+		w.forbidEnabled[k] = struct{}{}
+		w.forbidden[t.Name] = err
+		w.steppermut.Unlock()
+		w.Enabled[t.Name] = formula.UNDEF
+		return
+	}
+	w.Enabled[t.Name] = formula.From(ok)
+}
+
+// updateEnabled updates the enabledness relation after the marking changed
+// from old to the current one, where changed is the list of places whose
+// marking has been modified. We only check again the transitions with an input
+// place in changed, or marked as dirty. The other transitions keep their
+// status and their witness, but we still need to update the marking in After
+// for the places that changed.
+func (w *Worker) updateEnabled(old pnml.Marking, changed []int) {
+	for _, pl := range changed {
+		for _, k := range w.Dependents[pl] {
+			w.dirty[k] = true
+		}
+	}
+	for k := range w.Trans {
+		if w.dirty[k] {
+			w.dirty[k] = false
+			w.checkEnabled(k)
 			continue
 		}
-		ok, err := w.check(k)
-		if err != nil {
-			// BEWARE!!: possible concurrent write to Stepper
-			w.steppermut.Lock()
-			w.forbidEnabled[k] = struct{}{}
-			w.forbidden[t.Name] = struct{}{}
-			w.steppermut.Unlock()
+		if w.After[k] == nil {
 			continue
 		}
-
-		if ok {
-			w.Enabled[t.Name] = formula.TRUE
+		m1 := make(pnml.Marking, len(w.After[k]))
+		copy(m1, w.After[k])
+		for _, pl := range changed {
+			m1[pl] = shiftHue(w.After[k][pl], old[pl], w.COL[pl])
 		}
+		w.After[k] = m1
 	}
 }
 
@@ -167,11 +228,13 @@ func (w *Worker) FireAtRandom(verbose bool) error {
 		w.computeEnabled()
 	}
 
-	choose := []string{}
-	for k, v := range w.Enabled {
-		if v.IsTrue() {
+	// We iterate over transitions in a fixed order (and not over the map
+	// Enabled) so that the choices only depend on the random generator.
+	choose := []int{}
+	for k, t := range w.Trans {
+		if w.Enabled[t.Name].IsTrue() {
 			// we also need to check that we can fire the transition
-			if _, ok := w.forbidFiring[w.TPosition[k]]; !ok {
+			if _, ok := w.forbidFiring[k]; !ok {
 				choose = append(choose, k)
 			}
 		}
@@ -191,9 +254,18 @@ func (w *Worker) FireAtRandom(verbose bool) error {
 		return fmt.Errorf("nothing to fire; restarting")
 	}
 
-	tname := choose[rand.Intn(len(choose))]
+	k := choose[w.rand.Intn(len(choose))]
 
-	w.Fire(w.TPosition[tname], verbose)
+	// We choose one of the possible bindings for transition k.
+	b, ok, err := w.randomBinding(k)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("transition %s has no binding", w.Trans[k].Name)
+	}
+
+	w.fire(k, b, verbose)
 	return nil
 }
 
@@ -208,24 +280,46 @@ func (w *Worker) Restart(verbose bool) {
 	}
 }
 
-// Fire updates the stepper with the result of firing transition t. If there are
-// no witnesses, we try to compute one. We do nothing when t is not enabled.
+// Fire updates the stepper with the result of firing transition t, using the
+// binding of its witness. We do nothing when t is not enabled.
 func (w *Worker) Fire(k int, verbose bool) {
 	if _, ok := w.forbidFiring[k]; ok {
 		return
 	}
-	if w.After[k] == nil {
+	if w.Enabled == nil {
+		w.Enabled = make(map[string]formula.Bool)
 		w.computeEnabled()
 	}
-	if !w.Enabled[w.Trans[k].Name].IsTrue() {
+	b, ok := w.witness(k)
+	if !ok {
 		return
 	}
+	w.fire(k, b, verbose)
+}
+
+// witness returns the binding used to compute the marking in After for
+// transition k, and false if k is not enabled. The environment of the
+// iterator of k does not always match After[k], for instance when the witness
+// was copied from m0 in NewWorker, and so computed by another worker, or when
+// the iterator was used by Bindings since. Hence we compute the witness again.
+func (w *Worker) witness(k int) (Binding, bool) {
+	w.checkEnabled(k)
+	if !w.Enabled[w.Trans[k].Name].IsTrue() || w.After[k] == nil {
+		return Binding{}, false
+	}
+	return Binding{Env: w.iter[k].Environment(), After: w.After[k]}, true
+}
+
+// fire updates the stepper with the result of firing transition k with binding
+// b. We assume that b is a valid binding for k in the current marking.
+func (w *Worker) fire(k int, b Binding, verbose bool) {
 	if verbose {
 		fmt.Println("----------------------------------")
-		fmt.Printf("%s %s\n", w.Trans[k].Name, w.iter[k].PrintVEnv(w.Net))
+		fmt.Printf("%s %s\n", w.Trans[k].Name, w.PrintVEnv(b.Env))
 		fmt.Println("----------------------------------")
 	}
-	w.update(w.After[k])
+	w.trace = append(w.trace, Step{Trans: k, Env: b.Env})
+	w.update(b.After)
 }
 
 // restart updates the State of w with the initial marking; m0 in the stepper.
@@ -233,13 +327,24 @@ func (w *Worker) restart() {
 	w.steppermut.Lock()
 	w.State = w.m0.Clone()
 	w.steppermut.Unlock()
+	w.trace = nil
 }
 
 // update changes the State of w with the colored marking m.
 func (w *Worker) update(m pnml.Marking) {
+	old := w.COL
 	w.COL = m.Clone()
+	changed := []int{}
 	for k, v := range w.Places {
-		w.PT[v.Name] = m[k].Sum()
+		if !old[k].Equal(w.COL[k]) {
+			changed = append(changed, k)
+			w.PT[v.Name] = w.COL[k].Card()
+		}
 	}
-	w.computeEnabled()
+	if w.Enabled == nil {
+		w.Enabled = make(map[string]formula.Bool)
+		w.computeEnabled()
+		return
+	}
+	w.updateEnabled(old, changed)
 }
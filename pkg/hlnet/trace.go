@@ -0,0 +1,148 @@
+// Copyright 2023. Silvano DAL ZILIO (LAAS-CNRS). All rights reserved. Use of
+// this source code is governed by the GNU Affero license that can be found in
+// the LICENSE file.
+
+package hlnet
+
+import (
+	"fmt"
+
+	"github.com/dalzilio/hue/pkg/formula"
+	"github.com/dalzilio/hue/pkg/pnml"
+)
+
+// Step is the type of elements in a Trace. It is the index of a transition
+// together with the binding used to fire it.
+type Step struct {
+	Trans int
+	Env   pnml.VEnv
+}
+
+// Trace is a sequence of firings starting from the initial marking. We also
+// keep the colored marking reached at the end of the sequence.
+type Trace struct {
+	Steps []Step
+	Final pnml.Marking
+}
+
+// Trace returns the sequence of transitions fired by the worker since the last
+// restart, together with the current marking.
+func (w *Worker) Trace() *Trace {
+	tr := Trace{
+		Steps: make([]Step, len(w.trace)),
+		Final: w.COL.Clone(),
+	}
+	copy(tr.Steps, w.trace)
+	return &tr
+}
+
+// CardinalityTrace returns a trace leading to a marking where query q can be
+// decided. This is the same as Trace, except when the verdict is obtained on
+// one of the markings in After (see EvaluateCardinalityQueries), in which case
+// we add the corresponding step to the trace. We return nil if q cannot be
+// decided.
+func (w *Worker) CardinalityTrace(q formula.Query) *Trace {
+	v, k, err := w.evaluateCardinality(q)
+	if _, ok := v.Value(); err != nil || !ok {
+		return nil
+	}
+	tr := w.Trace()
+	if k >= 0 {
+		b, ok := w.witness(k)
+		if !ok {
+			return nil
+		}
+		tr.Steps = append(tr.Steps, Step{Trans: k, Env: b.Env})
+		tr.Final = b.After.Clone()
+	}
+	return tr
+}
+
+// ----------------------------------------------------------------------
+
+// PrintTrace returns a readable description of a trace, with one transition
+// and binding per line, followed by the final marking.
+func (net *Net) PrintTrace(tr *Trace) string {
+	s := ""
+	for _, st := range tr.Steps {
+		s += fmt.Sprintf("%s %s\n", net.Trans[st.Trans].Name, net.PrintVEnv(st.Env))
+	}
+	s += "# final marking\n"
+	for k, v := range net.Places {
+		s += fmt.Sprintf("%s : %s\n", v.Name, net.PrintHue(tr.Final[k]))
+	}
+	return s
+}
+
+// JSONTrace is the type of traces in JSON format. Values are given using the
+// same syntax than with PrintValue. Query and Verdict are optional.
+type JSONTrace struct {
+	Net     string                `json:"net"`
+	Query   string                `json:"query,omitempty"`
+	Verdict string                `json:"verdict,omitempty"`
+	Steps   []JSONStep            `json:"steps"`
+	Marking map[string][]JSONAtom `json:"marking"`
+}
+
+// JSONStep is the type of steps in a JSONTrace. Binding associates a variable
+// name with a value.
+type JSONStep struct {
+	Trans   string            `json:"transition"`
+	Binding map[string]string `json:"binding"`
+}
+
+// JSONAtom is the type of colored tokens in the marking of a JSONTrace. We
+// only list places with a non-empty marking.
+type JSONAtom struct {
+	Value string `json:"value"`
+	Mult  int    `json:"mult"`
+}
+
+// JSONTrace returns a representation of tr that can be marshalled into JSON.
+func (net *Net) JSONTrace(tr *Trace) JSONTrace {
+	res := JSONTrace{
+		Net:     net.Name,
+		Steps:   make([]JSONStep, len(tr.Steps)),
+		Marking: make(map[string][]JSONAtom),
+	}
+	for i, st := range tr.Steps {
+		res.Steps[i] = JSONStep{Trans: net.Trans[st.Trans].Name, Binding: make(map[string]string)}
+		for vname, val := range st.Env {
+			res.Steps[i].Binding[vname] = net.PrintValue(val)
+		}
+	}
+	for k, v := range net.Places {
+		if len(tr.Final[k]) == 0 {
+			continue
+		}
+		atoms := make([]JSONAtom, len(tr.Final[k]))
+		for i, a := range tr.Final[k] {
+			atoms[i] = JSONAtom{Value: net.PrintValue(a.Value), Mult: a.Mult}
+		}
+		res.Marking[v.Name] = atoms
+	}
+	return res
+}
+
+// ParseJSONTrace returns the list of steps described in a JSONTrace. We check
+// that transitions and values are defined in the net, but not that the trace
+// can be fired.
+func (net *Net) ParseJSONTrace(jt JSONTrace) ([]Step, error) {
+	steps := make([]Step, len(jt.Steps))
+	for i, st := range jt.Steps {
+		k, ok := net.TPosition[st.Trans]
+		if !ok {
+			return nil, fmt.Errorf("step %d: unknown transition %s", i+1, st.Trans)
+		}
+		venv := make(pnml.VEnv)
+		for vname, s := range st.Binding {
+			val, err := net.ParseValue(s)
+			if err != nil {
+				return nil, fmt.Errorf("step %d: variable %s, %s", i+1, vname, err)
+			}
+			venv[vname] = val
+		}
+		steps[i] = Step{Trans: k, Env: venv}
+	}
+	return steps, nil
+}
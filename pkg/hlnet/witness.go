@@ -5,8 +5,6 @@
 package hlnet
 
 import (
-	"sort"
-
 	"github.com/dalzilio/hue/pkg/pnml"
 )
 
@@ -27,46 +25,53 @@ func (a *arcIterator) testCapacity(h pnml.Hue) bool {
 	return true
 }
 
-// getWitness returns a witness for the current match on transition k.
-func (w *Worker) getWitness(k int) pnml.Marking {
-	m1 := w.COL.Clone()
+// getWitness returns a witness for the current match on transition k. Only the
+// Hues of places connected to k are changed; the other ones are shared with the
+// current marking.
+func (w *Worker) getWitness(k int) (pnml.Marking, error) {
+	m1 := make(pnml.Marking, len(w.COL))
+	copy(m1, w.COL)
 	it := w.iter[k]
 	tr := w.Trans[k]
 
-	// We start by removing the Pre.
+	// We start by removing the Pre. We already checked that the multiset
+	// patterns are included in the marking.
+	pre := make(map[int][]pnml.Atom)
 	for _, a := range it.arcs {
 		for j, p := range a.pos {
-			m1[a.pl][p].Mult -= a.mults[j]
+			pre[a.pl] = append(pre[a.pl], pnml.Atom{Value: w.COL[a.pl][p].Value, Mult: a.mults[j]})
+		}
+	}
+	for _, m := range it.msets {
+		for _, e := range m.pre {
+			mset, err := e.Eval(w.Net.Net, it.venv)
+			if err != nil {
+				return nil, err
+			}
+			pre[m.pl] = append(pre[m.pl], mset...)
 		}
 	}
+	for pl, atoms := range pre {
+		m1[pl] = m1[pl].Diff(pnml.NewMultiset(atoms))
+	}
 
 	// We add the Post.
 	for _, a := range tr.Outs {
 		for _, e := range a.Pattern {
-			m1[a.Place] = append(m1[a.Place], e.Eval(w.Net.Net, it.venv)...)
-		}
-	}
-
-	// We need to shorten the marking but also to remove duplicates. We
-	// start to sort the slice to simplify the logic.
-	for pl, h := range m1 {
-		sort.Slice(h, func(a, b int) bool { return pnml.AtomIsLess(h[a], h[b]) })
-		removed := 0
-		j := 0
-		for i := 0; i < len(h); i++ {
-			if h[i].Mult == 0 {
-				removed++
-				continue
-			}
-			if (j != 0) && (h[i].Value == h[j-1].Value) {
-				removed++
-				h[j-1].Mult += h[i].Mult
-				continue
+			post, err := e.Eval(w.Net.Net, it.venv)
+			if err != nil {
+				return nil, err
 			}
-			h[j] = h[i]
-			j++
+			m1[a.Place] = m1[a.Place].Union(post)
 		}
-		m1[pl] = h[:len(m1[pl])-removed]
 	}
-	return m1
+	return m1, nil
+}
+
+// shiftHue returns the Hue cur + (after - old). This is used to update the
+// marking in a place after a firing. We assume that after is obtained from old
+// by adding the result of an output arc, which means that (after - old) is
+// always positive.
+func shiftHue(after, old, cur pnml.Hue) pnml.Hue {
+	return cur.Union(after.Diff(old))
 }
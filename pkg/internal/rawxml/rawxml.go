@@ -0,0 +1,80 @@
+// Copyright 2023. Silvano DAL ZILIO (LAAS-CNRS). All rights reserved. Use of
+// this source code is governed by the GNU Affero license that can be found in
+// the LICENSE file.
+
+// Package rawxml is used to keep the content of an XML element that is parsed
+// in a second pass, like PNML expressions or formulas, together with its
+// position in the original file. This way we can report errors found during
+// the second pass with a position in the file.
+package rawxml
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+)
+
+// RawXML is the content of an XML element. We also keep the position of the
+// content in the original file, with its line and column (starting from 1) and
+// its byte offset.
+type RawXML struct {
+	InnerXML []byte
+	Line     int
+	Col      int
+	Offset   int64
+}
+
+// UnmarshalXML records the position of the content of element start before
+// copying it in InnerXML.
+func (r *RawXML) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	r.Line, r.Col = d.InputPos()
+	r.Offset = d.InputOffset()
+	var inner struct {
+		InnerXML []byte `xml:",innerxml"`
+	}
+	if err := d.DecodeElement(&inner, &start); err != nil {
+		return err
+	}
+	r.InnerXML = inner.InnerXML
+	return nil
+}
+
+// Position returns the position in the original file of a position (line,
+// col) relative to the content of r.
+func (r RawXML) Position(line, col int) (int, int) {
+	if line == 1 {
+		col += r.Col - 1
+	}
+	return line + r.Line - 1, col
+}
+
+// Locate updates err, when it is a SyntaxError found while parsing the content
+// of r, with its position in the original file and with id, that describes the
+// enclosing node. It returns err.
+func (r RawXML) Locate(err error, id string) error {
+	var serr *SyntaxError
+	if errors.As(err, &serr) {
+		serr.Line, serr.Col = r.Position(serr.Line, serr.Col)
+		serr.ID = id
+	}
+	return err
+}
+
+// SyntaxError is the type of errors found when parsing the content of a RawXML.
+// Kind describes this content, for instance "PNML" or "formula". Line and Col
+// give the position of the faulty element, and ID describes the enclosing node
+// (for instance a transition or a property).
+type SyntaxError struct {
+	Kind string
+	ID   string
+	Line int
+	Col  int
+	Msg  string
+}
+
+func (e *SyntaxError) Error() string {
+	if e.ID == "" {
+		return fmt.Sprintf("malformed %s at line %d, column %d: %s", e.Kind, e.Line, e.Col, e.Msg)
+	}
+	return fmt.Sprintf("malformed %s at line %d, column %d (in %s): %s", e.Kind, e.Line, e.Col, e.ID, e.Msg)
+}
@@ -0,0 +1,281 @@
+// Copyright 2023. Silvano DAL ZILIO (LAAS-CNRS). All rights reserved. Use of
+// this source code is governed by the GNU Affero license that can be found in
+// the LICENSE file.
+
+package pnml
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TypeError is the type of errors found when checking the sorts of the
+// expressions in a net. ID tells where the error occurs: a place, a transition
+// or an arc.
+type TypeError struct {
+	ID  string
+	Msg string
+}
+
+func (e TypeError) Error() string {
+	return e.ID + ": " + e.Msg
+}
+
+// TypeErrors is the list of all the type errors found in a net. This is the
+// type of the error returned by Build when a net is not well sorted.
+type TypeErrors []TypeError
+
+func (ee TypeErrors) Error() string {
+	res := make([]string, len(ee))
+	for i, e := range ee {
+		res[i] = e.Error()
+	}
+	return fmt.Sprintf("%d type error(s) in net\n", len(ee)) + strings.Join(res, "\n")
+}
+
+// ----------------------------------------------------------------------
+
+// checker is used to infer the sort of expressions in a net and to collect
+// the errors we find along the way.
+type checker struct {
+	*Net
+	id   string // description of the node we are checking
+	errs TypeErrors
+}
+
+func (c *checker) errorf(format string, a ...interface{}) {
+	c.errs = append(c.errs, TypeError{ID: c.id, Msg: fmt.Sprintf(format, a...)})
+}
+
+// check infers the sort of every expression in the (flattened) page of the
+// net. It checks that the initial marking of each place, and the patterns on
+// its arcs, have the sort of the place, and that conditions are well sorted.
+// We return all the errors found in the net, and not only the first one.
+func (net *Net) check() error {
+	c := &checker{Net: net}
+	psort := make(map[string]string, len(net.Page.Places))
+	for _, p := range net.Page.Places {
+		c.id = "place " + p.ID
+		s := net.canonicalSort(p.Type.ID)
+		if s == "" {
+			c.errorf("unknown sort %s", p.Type.ID)
+		}
+		psort[p.ID] = s
+		if p.InitialMarking != nil {
+			c.expect(p.InitialMarking, s, "initial marking")
+		}
+	}
+
+	trans := make(map[string]bool, len(net.Page.Trans))
+	for _, t := range net.Page.Trans {
+		c.id = "transition " + t.ID
+		trans[t.ID] = true
+		c.condition(t.Condition)
+	}
+
+	for _, a := range net.Page.Arcs {
+		c.id = a.describe()
+		pl := a.Source
+		if _, ok := psort[pl]; !ok {
+			pl = a.Target
+		}
+		s, ok := psort[pl]
+		if !ok || !(trans[a.Source] || trans[a.Target]) {
+			c.errorf("an arc should connect a place and a transition")
+			continue
+		}
+		if a.Pattern != nil {
+			c.expect(a.Pattern, s, "pattern")
+		}
+	}
+
+	if len(c.errs) != 0 {
+		return c.errs
+	}
+	return nil
+}
+
+// expect checks that expression e, described by what, has sort s. We do not
+// report an error when one of the sorts is unknown.
+func (c *checker) expect(e Expression, s string, what string) {
+	if es := c.sortOf(e); es != "" && s != "" && es != s {
+		c.errorf("%s %s has sort %s, expected %s", what, e, es, s)
+	}
+}
+
+// same returns the sort shared by the expressions in ee, and reports an error
+// if they do not agree.
+func (c *checker) same(ee []Expression, what string) string {
+	res := ""
+	for _, e := range ee {
+		s := c.sortOf(e)
+		switch {
+		case s == "":
+		case res == "":
+			res = s
+		case s != res:
+			c.errorf("%s %s mixes sorts %s and %s", what, e, res, s)
+		}
+	}
+	return res
+}
+
+// partition returns the declaration of partition id, or nil if there is none.
+func (c *checker) partition(id string) *PartitionDecl {
+	for _, p := range c.Declaration.Partitions {
+		if p.ID == id {
+			return p
+		}
+	}
+	return nil
+}
+
+// element returns the partition containing the partition element with name
+// id, or nil if there is none.
+func (c *checker) element(id string) *PartitionDecl {
+	for _, p := range c.Declaration.Partitions {
+		for _, pe := range p.Partitions {
+			if pe.ID == id {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+// ----------------------------------------------------------------------
+
+// sortOf returns the canonical name of the sort of expression e, see
+// canonicalSort. For an expression denoting a multiset, we return the sort of
+// its elements. The result is the empty string if we cannot infer a sort,
+// which is not considered as an error.
+func (c *checker) sortOf(e Expression) string {
+	switch e := e.(type) {
+	case Var:
+		s, ok := c.TypeEnvt[string(e)]
+		if !ok {
+			c.errorf("variable %s is not declared", e)
+			return ""
+		}
+		return c.canonicalSort(s)
+	case Constant:
+		if typ, ok := c.types[string(e)]; ok {
+			return c.canonicalSort(typ.ID)
+		}
+		if p := c.element(string(e)); p != nil {
+			// the name of a partition element, outside of a comparison,
+			// denotes the multiset of its members (see VehicularWifi)
+			return c.canonicalSort(p.Type.ID)
+		}
+		switch string(e) {
+		case "integer", "natural", "positive", "bool":
+			return ""
+		}
+		c.errorf("unknown constant %s", e)
+		return ""
+	case FIRConstant:
+		typ, ok := c.ranges[IntRange{Start: e.start, End: e.end}]
+		if !ok {
+			c.errorf("no sort declared for the range of %s", e)
+			return ""
+		}
+		if e.value < e.start || e.value > e.end {
+			c.errorf("constant %s is out of its range", e)
+		}
+		return typ.ID
+	case Dot:
+		return "dot"
+	case IntConstant:
+		return "integer"
+	case BoolConstant:
+		return "bool"
+	case All:
+		s := c.canonicalSort(string(e))
+		if s == "" {
+			c.errorf("unknown sort %s in %s", string(e), e)
+		}
+		return s
+	case Add:
+		return c.same(e, "sum")
+	case Subtract:
+		return c.same(e, "subtraction")
+	case Tuple:
+		comps := make([]string, len(e))
+		for i, x := range e {
+			comps[i] = c.sortOf(x)
+		}
+		return prodSort(comps)
+	case Operation:
+		c.condition(e)
+		return "bool"
+	case Arithmetic:
+		for _, x := range e.Elem {
+			c.expect(x, "integer", "operand")
+		}
+		return "integer"
+	case Successor:
+		return c.sortOf(e.Expression)
+	case Numberof:
+		if e.Expression == nil {
+			c.errorf("multiplicity %d without a color", e.Mult)
+			return ""
+		}
+		return c.sortOf(e.Expression)
+	case ScalarProduct:
+		c.expect(e.Mult, "integer", "multiplicity")
+		return c.sortOf(e.Expression)
+	case Cardinality:
+		c.sortOf(e.Expression)
+		return "integer"
+	case CardinalityOf:
+		c.same([]Expression{e.Multiset, e.Color}, "cardinality")
+		return "integer"
+	case Contains:
+		c.same(e, "inclusion")
+		return "bool"
+	case PartitionElementOf:
+		p := c.partition(e.Partition)
+		if p == nil {
+			c.errorf("unknown partition %s", e.Partition)
+			return ""
+		}
+		c.expect(e.Expression, c.canonicalSort(p.Type.ID), "argument of partition")
+		return p.ID
+	}
+	return ""
+}
+
+// condition checks that the boolean operators in op are applied to boolean
+// expressions and that the operands of comparisons have the same sort.
+func (c *checker) condition(op Operation) {
+	switch op.Op {
+	case NIL:
+	case AND, OR, NOT, IMPLY:
+		for _, e := range op.Elem {
+			c.expect(e, "bool", "operand")
+		}
+	case EQ, INEQ, LESSTHAN, LESSTHANEQ, GREATTHAN, GREATTHANEQ:
+		if len(op.Elem) != 2 {
+			c.errorf("comparison %s should have two operands", op)
+			return
+		}
+		s1, s2 := c.operand(op.Elem[0]), c.operand(op.Elem[1])
+		if s1 != "" && s2 != "" && s1 != s2 {
+			c.errorf("cannot compare %s of sort %s with %s of sort %s", op.Elem[0], s1, op.Elem[1], s2)
+		}
+	default:
+		c.errorf("%s is not a condition", op)
+	}
+}
+
+// operand returns the sort of an operand in a comparison. This is like
+// sortOf, except that the name of a partition element denotes the element
+// itself, like in evalColor.
+func (c *checker) operand(e Expression) string {
+	if k, ok := e.(Constant); ok {
+		if p := c.element(string(k)); p != nil {
+			return p.ID
+		}
+	}
+	return c.sortOf(e)
+}
@@ -0,0 +1,412 @@
+// Copyright 2023. Silvano DAL ZILIO (LAAS-CNRS). All rights reserved. Use of
+// this source code is governed by the GNU Affero license that can be found in
+// the LICENSE file.
+
+package pnml
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// SymmetricNet is the type of PNML files describing symmetric nets. This is
+// the type of the documents written by an Encoder.
+const SymmetricNet = "http://www.pnml.org/version-2009/grammar/symmetricnet"
+
+// An Encoder writes PNML documents to an output stream. It embeds an
+// xml.Encoder, like Decoder embeds an xml.Decoder.
+type Encoder struct {
+	*xml.Encoder
+	err error // first error found while writing tokens
+}
+
+// NewEncoder returns a new encoder that writes to w.
+func NewEncoder(w io.Writer) *Encoder {
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return &Encoder{Encoder: enc}
+}
+
+// Encode writes net as a symmetric net PNML document. We use the declarations
+// of the net and the expressions found in its (flattened) page, so that the
+// result can be read back using Build. Arcs without an identifier are numbered
+// in the order of the page.
+func (enc *Encoder) Encode(net *Net) error {
+	enc.err = nil
+	enc.token(xml.ProcInst{Target: "xml", Inst: []byte(`version="1.0" encoding="UTF-8"`)})
+	enc.start("pnml", "xmlns", "http://www.pnml.org/version-2009/grammar/pnml")
+	enc.start("net", "id", net.Name, "type", SymmetricNet)
+	enc.name(net.Name)
+	enc.declarations(net.Declaration)
+
+	id := net.Page.ID
+	if id == "" {
+		id = "page"
+	}
+	enc.start("page", "id", id)
+	for _, p := range net.Page.Places {
+		enc.start("place", "id", p.ID)
+		enc.name(p.ID)
+		enc.start("type")
+		enc.start("structure")
+		enc.empty("usersort", "declaration", p.Type.ID)
+		enc.end("structure")
+		enc.end("type")
+		if p.InitialMarking != nil {
+			enc.structure("hlinitialMarking", p.InitialMarking)
+		}
+		enc.end("place")
+	}
+	for _, t := range net.Page.Trans {
+		enc.start("transition", "id", t.ID)
+		enc.name(t.ID)
+		if t.Condition.Op != NIL {
+			enc.structure("condition", t.Condition)
+		}
+		enc.end("transition")
+	}
+	for i, a := range net.Page.Arcs {
+		id := a.ID
+		if id == "" {
+			id = "arc" + strconv.Itoa(i+1)
+		}
+		enc.start("arc", "id", id, "source", a.Source, "target", a.Target)
+		if a.Pattern != nil {
+			enc.structure("hlinscription", a.Pattern)
+		}
+		enc.end("arc")
+	}
+	enc.end("page")
+
+	enc.end("net")
+	enc.end("pnml")
+	if err := enc.Flush(); err != nil {
+		return err
+	}
+	return enc.err
+}
+
+// ----------------------------------------------------------------------
+
+// token writes token t and records the first error, so that we only need to
+// check errors once, at the end of Encode.
+func (enc *Encoder) token(t xml.Token) {
+	if err := enc.EncodeToken(t); err != nil && enc.err == nil {
+		enc.err = err
+	}
+}
+
+// start writes a start element with the given attributes, given as a list of
+// names and values.
+func (enc *Encoder) start(name string, attrs ...string) {
+	se := xml.StartElement{Name: xml.Name{Local: name}}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		se.Attr = append(se.Attr, xml.Attr{Name: xml.Name{Local: attrs[i]}, Value: attrs[i+1]})
+	}
+	enc.token(se)
+}
+
+func (enc *Encoder) end(name string) {
+	enc.token(xml.EndElement{Name: xml.Name{Local: name}})
+}
+
+func (enc *Encoder) empty(name string, attrs ...string) {
+	enc.start(name, attrs...)
+	enc.end(name)
+}
+
+func (enc *Encoder) name(s string) {
+	enc.start("name")
+	enc.start("text")
+	enc.token(xml.CharData(s))
+	enc.end("text")
+	enc.end("name")
+}
+
+// structure writes expression e as the structure of an element called name,
+// like a condition or an arc inscription.
+func (enc *Encoder) structure(name string, e Expression) {
+	enc.start(name)
+	enc.start("structure")
+	enc.term(e)
+	enc.end("structure")
+	enc.end(name)
+}
+
+// ----------------------------------------------------------------------
+
+func (enc *Encoder) declarations(decl Declaration) {
+	enc.start("declaration")
+	enc.start("structure")
+	enc.start("declarations")
+	for _, s := range decl.Sorts {
+		enc.start("namedsort", "id", s.ID, "name", s.ID)
+		enc.sort(s)
+		enc.end("namedsort")
+	}
+	for _, p := range decl.Partitions {
+		enc.start("partition", "id", p.ID, "name", p.ID)
+		enc.empty("usersort", "declaration", p.Type.ID)
+		for _, pe := range p.Partitions {
+			enc.start("partitionelement", "id", pe.ID, "name", pe.ID)
+			for _, e := range pe.Elem {
+				enc.empty("useroperator", "declaration", e.ID)
+			}
+			enc.end("partitionelement")
+		}
+		enc.end("partition")
+	}
+	for _, v := range decl.Vars {
+		enc.start("variabledecl", "id", v.ID, "name", v.ID)
+		switch {
+		case v.Bool != nil:
+			enc.empty("bool")
+		case v.NumSort.Name() != "":
+			enc.empty(v.NumSort.Name())
+		default:
+			enc.empty("usersort", "declaration", v.Type.ID)
+		}
+		enc.end("variabledecl")
+	}
+	enc.end("declarations")
+	enc.end("structure")
+	enc.end("declaration")
+}
+
+func (enc *Encoder) sort(s *TypeDecl) {
+	switch s.Sort {
+	case DOT:
+		enc.empty("dot")
+	case CENUM, FENUM:
+		name := "finiteenumeration"
+		if s.Sort == CENUM {
+			name = "cyclicenumeration"
+		}
+		enc.start(name)
+		for _, c := range s.Elem {
+			enc.empty("feconstant", "id", c, "name", c)
+		}
+		enc.end(name)
+	case FINTRANGE:
+		enc.empty("finiteintrange", "start", strconv.Itoa(s.FIntRan.Start), "end", strconv.Itoa(s.FIntRan.End))
+	case PROD:
+		enc.start("productsort")
+		for _, c := range s.Elem {
+			enc.empty("usersort", "declaration", c)
+		}
+		enc.end("productsort")
+	case NUMERIC:
+		enc.empty(s.NumSort.Name())
+	case BOOL:
+		enc.empty("bool")
+	case ALIAS:
+		enc.empty("usersort", "declaration", s.Elem[0])
+	}
+}
+
+// ----------------------------------------------------------------------
+
+// term writes expression e as a PNML term. This is the converse of
+// parseExprElement.
+func (enc *Encoder) term(e Expression) {
+	switch e := e.(type) {
+	case All:
+		enc.start("all")
+		enc.empty("usersort", "declaration", string(e))
+		enc.end("all")
+	case Add:
+		enc.subterms("add", e...)
+	case Subtract:
+		enc.subterms("subtract", e...)
+	case Tuple:
+		enc.subterms("tuple", e...)
+	case Operation:
+		if e.Op == NIL {
+			enc.empty("booleanconstant", "value", "true")
+			return
+		}
+		enc.subterms(e.Op.element(), e.Elem...)
+	case Arithmetic:
+		enc.subterms(e.Op.element(), e.Elem...)
+	case BoolConstant:
+		enc.empty("booleanconstant", "value", strconv.FormatBool(bool(e)))
+	case Constant:
+		switch string(e) {
+		case "integer", "natural", "positive", "bool":
+			enc.empty(string(e))
+		default:
+			enc.empty("useroperator", "declaration", string(e))
+		}
+	case FIRConstant:
+		enc.start("finiteintrangeconstant", "value", strconv.Itoa(e.value))
+		enc.empty("finiteintrange", "start", strconv.Itoa(e.start), "end", strconv.Itoa(e.end))
+		enc.end("finiteintrangeconstant")
+	case IntConstant:
+		enc.number(int(e))
+	case Var:
+		enc.empty("variable", "refvariable", string(e))
+	case Dot:
+		enc.empty("dotconstant")
+	case Successor:
+		name, n := "successor", e.Incr
+		if n < 0 {
+			name, n = "predecessor", -n
+		}
+		for i := 0; i < n; i++ {
+			enc.start(name)
+			enc.start("subterm")
+		}
+		enc.term(e.Expression)
+		for i := 0; i < n; i++ {
+			enc.end("subterm")
+			enc.end(name)
+		}
+	case Numberof:
+		if e.Expression == nil {
+			enc.number(e.Mult)
+			return
+		}
+		enc.start("numberof")
+		enc.start("subterm")
+		enc.number(e.Mult)
+		enc.end("subterm")
+		enc.start("subterm")
+		enc.term(e.Expression)
+		enc.end("subterm")
+		enc.end("numberof")
+	case ScalarProduct:
+		enc.subterms("scalarproduct", e.Mult, e.Expression)
+	case Cardinality:
+		enc.subterms("cardinality", e.Expression)
+	case CardinalityOf:
+		enc.subterms("cardinalityof", e.Multiset, e.Color)
+	case Contains:
+		enc.subterms("contains", e...)
+	case PartitionElementOf:
+		enc.start("partitionelementof", "refpartition", e.Partition)
+		enc.start("subterm")
+		enc.term(e.Expression)
+		enc.end("subterm")
+		enc.end("partitionelementof")
+	default:
+		if enc.err == nil {
+			enc.err = fmt.Errorf("cannot encode expression %s of type %T", e, e)
+		}
+	}
+}
+
+func (enc *Encoder) subterms(name string, ee ...Expression) {
+	enc.start(name)
+	for _, e := range ee {
+		enc.start("subterm")
+		enc.term(e)
+		enc.end("subterm")
+	}
+	enc.end(name)
+}
+
+func (enc *Encoder) number(n int) {
+	sort := "positive"
+	switch {
+	case n < 0:
+		sort = "integer"
+	case n == 0:
+		sort = "natural"
+	}
+	enc.start("numberconstant", "value", strconv.Itoa(n))
+	enc.empty(sort)
+	enc.end("numberconstant")
+}
+
+// element returns the name of the PNML element for operation p. This is the
+// converse of getpOP.
+func (p OP) element() string {
+	switch p {
+	case EQ:
+		return "equality"
+	case INEQ:
+		return "inequality"
+	case LESSTHAN:
+		return "lessthan"
+	case LESSTHANEQ:
+		return "lessthanorequal"
+	case GREATTHAN:
+		return "greaterthan"
+	case GREATTHANEQ:
+		return "greaterthanorequal"
+	case OR:
+		return "or"
+	case AND:
+		return "and"
+	case NOT:
+		return "not"
+	case IMPLY:
+		return "imply"
+	case ADDITION:
+		return "addition"
+	case SUBTRACTION:
+		return "subtraction"
+	case MULT:
+		return "mult"
+	case DIV:
+		return "div"
+	case MOD:
+		return "mod"
+	}
+	return ""
+}
+
+// ----------------------------------------------------------------------
+
+// ValueExpr returns a ground expression that evaluates to value v. Tuples
+// are returned as a flat Tuple of their components.
+func (net *Net) ValueExpr(v *Value) Expression {
+	if v.Tail != nil {
+		t := Tuple{}
+		for c := v; c != nil; c = c.Tail {
+			t = append(t, net.ValueExpr(&Value{Head: c.Head}))
+		}
+		return t
+	}
+	if n, ok := net.IntOf(v); ok {
+		return IntConstant(n)
+	}
+	switch v.Head {
+	case net.vdot.Head:
+		return Dot{}
+	case net.vfalse.Head:
+		return BoolConstant(false)
+	case net.vtrue.Head:
+		return BoolConstant(true)
+	}
+	name := net.identity[v.Head]
+	if typ, ok := net.types[name]; ok && typ.Sort == FINTRANGE {
+		return FIRConstant{
+			value: typ.FIntRan.Start + net.position[name],
+			start: typ.FIntRan.Start,
+			end:   typ.FIntRan.End,
+		}
+	}
+	return Constant(name)
+}
+
+// HueExpr returns a ground expression that evaluates to the multiset h, or
+// nil if h is empty.
+func (net *Net) HueExpr(h Hue) Expression {
+	res := Add{}
+	for _, a := range h {
+		if a.Mult == 0 {
+			continue
+		}
+		res = append(res, Numberof{Expression: net.ValueExpr(a.Value), Mult: a.Mult})
+	}
+	switch len(res) {
+	case 0:
+		return nil
+	case 1:
+		return res[0]
+	}
+	return res
+}
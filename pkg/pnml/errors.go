@@ -0,0 +1,61 @@
+// Copyright 2023. Silvano DAL ZILIO (LAAS-CNRS). All rights reserved. Use of
+// this source code is governed by the GNU Affero license that can be found in
+// the LICENSE file.
+
+package pnml
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dalzilio/hue/pkg/internal/rawxml"
+)
+
+// ErrUnsupportedFeature is the sentinel error for constructs that are valid
+// PNML but that we cannot handle, like the unification of an arc pattern that
+// is not injective. Errors of this kind are of type *UnsupportedError, that
+// gives the offending construct, and can be tested using errors.Is.
+var ErrUnsupportedFeature = errors.New("unsupported feature")
+
+// ErrEvaluation is the sentinel error for expressions that cannot be
+// evaluated, for instance when a comparison is applied to a multiset. This
+// should not happen with nets accepted by the type checker.
+var ErrEvaluation = errors.New("evaluation error")
+
+// ErrUndefined is returned by Eval when the value of an expression is
+// undefined, like the successor of the last constant in a finite enumeration
+// or a division by zero. This is not the same than an empty multiset. A
+// binding where an arc pattern is undefined is not valid, and a comparison
+// with an undefined operand is false.
+var ErrUndefined = errors.New("undefined value")
+
+// SyntaxError is the type of errors found when parsing the expressions in a
+// PNML file. ID describes the enclosing place, transition or arc.
+type SyntaxError = rawxml.SyntaxError
+
+// UnsupportedError is the type of errors returned when we find a construct
+// that we do not support. Construct is a description of this construct.
+type UnsupportedError struct {
+	Construct string
+}
+
+func (e *UnsupportedError) Error() string {
+	return "unsupported feature: " + e.Construct
+}
+
+// Is reports whether target is ErrUnsupportedFeature, so that errors.Is works
+// on (wrapped) UnsupportedErrors.
+func (e *UnsupportedError) Is(target error) bool {
+	return target == ErrUnsupportedFeature
+}
+
+// Unsupported returns an UnsupportedError whose construct is described using a
+// format specifier, like with fmt.Sprintf.
+func Unsupported(format string, a ...interface{}) error {
+	return &UnsupportedError{Construct: fmt.Sprintf(format, a...)}
+}
+
+// evalError returns an error wrapping ErrEvaluation.
+func evalError(format string, a ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrEvaluation, fmt.Sprintf(format, a...))
+}
@@ -5,8 +5,8 @@
 package pnml
 
 import (
+	"errors"
 	"fmt"
-	"log"
 	"sort"
 	"strconv"
 
@@ -26,9 +26,11 @@ import (
 // expression to an alreay existing environment. It creates a (sorted) slice
 // containing the names of all the variables.
 //
-// Eval returns the set of constant values that match a ground Expression (an
-// expression without free variables, such as the ones used to define the
-// initial marking), together with their multiplicities.
+// Eval returns the multiset of constant values that match a ground Expression
+// (an expression without free variables, such as the ones used to define the
+// initial marking). It returns an error
+// when the expression cannot be evaluated, for instance with an unknown
+// identifier or a comparison between multisets.
 //
 // Unify reports if a pattern expression matches a given *Value. For this we can
 // use the VEnv to check that we respect previously unified variables. We can
@@ -40,41 +42,34 @@ import (
 type Expression interface {
 	String() string
 	AddEnv(Env) Env
-	Eval(*Net, VEnv) []Atom
+	Eval(*Net, VEnv) (Multiset, error)
 	Unify(*Net, *Value, VEnv) (int, error)
 }
 
 // ----------------------------------------------------------------------
 
-func (net *Net) compareExp(p1, p2 *Value, op OP) bool {
+// compareExp compares two values of the same sort using operator op. Values
+// are ordered using their position in their sort, and tuples are ordered
+// lexicographically (see compareValues).
+func (net *Net) compareExp(p1, p2 *Value, op OP) (bool, error) {
 	switch op {
 	case EQ:
-		return p1 == p2
+		return p1 == p2, nil
+	case INEQ:
+		return p1 != p2, nil
+	}
+	c := net.compareValues(p1, p2)
+	switch op {
 	case GREATTHAN:
-		if p1.Head >= 0 {
-			return p1.Head > p2.Head
-		}
-		return p1.Head < p2.Head
+		return c > 0, nil
 	case GREATTHANEQ:
-		if p1.Head >= 0 {
-			return p1.Head >= p2.Head
-		}
-		return p1.Head <= p2.Head
-	case INEQ:
-		return p1 != p2
+		return c >= 0, nil
 	case LESSTHAN:
-		if p1.Head >= 0 {
-			return p1.Head < p2.Head
-		}
-		return p1.Head > p2.Head
+		return c < 0, nil
 	case LESSTHANEQ:
-		if p1.Head >= 0 {
-			return p1.Head <= p2.Head
-		}
-		return p1.Head >= p2.Head
+		return c <= 0, nil
 	}
-	log.Panic("not reachable in compareExp")
-	panic("")
+	return false, Unsupported("comparison operator %d", op)
 }
 
 // ----------------------------------------------------------------------
@@ -88,13 +83,16 @@ func (p All) String() string {
 
 func (p All) AddEnv(env Env) Env { return env }
 
-func (p All) Eval(net *Net, venv VEnv) []Atom {
-	f := net.World[string(p)]
+func (p All) Eval(net *Net, venv VEnv) (Multiset, error) {
+	f, ok := net.World[string(p)]
+	if !ok {
+		return nil, Unsupported("<all> on sort %s, that is not finite", string(p))
+	}
 	m := make([]Atom, len(f))
 	for i := range f {
 		m[i] = Atom{f[i], 1}
 	}
-	return m
+	return NewMultiset(m), nil
 }
 
 // This is one of the rare cases where we need to match against several values
@@ -102,7 +100,7 @@ func (p All) Eval(net *Net, venv VEnv) []Atom {
 // and on model QuasiCertifProtocol. We could return a negative number in order
 // to test for this particular case but the model has other problems.
 func (p All) Unify(net *Net, v *Value, venv VEnv) (int, error) {
-	return -1, fmt.Errorf("try to apply Unify to an <All> expression")
+	return -1, Unsupported("unification of <all> expression %s", p)
 }
 
 // ----------------------------------------------------------------------
@@ -118,16 +116,20 @@ func (p Add) AddEnv(env Env) Env {
 	return multaddEnv(p, env)
 }
 
-func (p Add) Eval(net *Net, venv VEnv) []Atom {
-	var res []Atom
+func (p Add) Eval(net *Net, venv VEnv) (Multiset, error) {
+	var res Multiset
 	for i := range p {
-		res = append(res, p[i].Eval(net, venv)...)
+		m, err := p[i].Eval(net, venv)
+		if err != nil {
+			return nil, err
+		}
+		res = res.Union(m)
 	}
-	return res
+	return res, nil
 }
 
 func (p Add) Unify(net *Net, v *Value, venv VEnv) (int, error) {
-	return -1, fmt.Errorf("try to apply Unify to an <Add> expression")
+	return -1, Unsupported("unification of <add> expression %s", p)
 }
 
 // ----------------------------------------------------------------------
@@ -144,41 +146,23 @@ func (p Subtract) AddEnv(env Env) Env {
 	return multaddEnv(p, env)
 }
 
-func (p Subtract) Eval(net *Net, venv VEnv) []Atom {
-	ma := p[0].Eval(net, venv)
-	if ma == nil || len(p) == 1 {
-		return ma
+func (p Subtract) Eval(net *Net, venv VEnv) (Multiset, error) {
+	ma, err := p[0].Eval(net, venv)
+	if err != nil || ma == nil || len(p) == 1 {
+		return ma, err
 	}
 	for i := 1; i < len(p); i++ {
-		mb := p[i].Eval(net, venv)
-		if mb == nil {
-			continue
+		mb, err := p[i].Eval(net, venv)
+		if err != nil {
+			return nil, err
 		}
-		ma = subtract(ma, mb)
+		ma = ma.Diff(mb)
 	}
-	return ma
+	return ma, nil
 }
 
 func (p Subtract) Unify(net *Net, v *Value, venv VEnv) (int, error) {
-	return -1, fmt.Errorf("try to apply Unify to a <Subtract> expression")
-}
-
-// subtract computes multiset difference, taking into account multiplicities
-func subtract(ma []Atom, mb []Atom) []Atom {
-	var res []Atom
-OUTER:
-	for _, a := range ma {
-		for _, b := range mb {
-			if a.Value == b.Value {
-				if a.Mult-b.Mult <= 0 {
-					continue OUTER
-				}
-				a.Mult = a.Mult - b.Mult
-			}
-		}
-		res = append(res, Atom{a.Value, a.Mult})
-	}
-	return res
+	return -1, Unsupported("unification of <subtract> expression %s", p)
 }
 
 // ----------------------------------------------------------------------
@@ -194,37 +178,53 @@ func (p Tuple) AddEnv(env Env) Env {
 	return multaddEnv(p, env)
 }
 
-func (p Tuple) Eval(net *Net, venv VEnv) []Atom {
+func (p Tuple) Eval(net *Net, venv VEnv) (Multiset, error) {
 	res := []Atom{{nil, 1}}
 	for i := len(p) - 1; i >= 0; i-- {
-		fi := p[i].Eval(net, venv)
+		fi, err := p[i].Eval(net, venv)
+		if err != nil {
+			return nil, err
+		}
 		fr := []Atom{}
 		for _, v1 := range fi {
 			for _, v2 := range res {
-				fr = append(fr, Atom{net.Unique[Value{Head: v1.Value.Head, Tail: v2.Value}], 1})
+				// components that are tuples, like a variable of a product
+				// sort, are flattened
+				fr = append(fr, Atom{net.concat(v1.Value, v2.Value, net.unique), 1})
 			}
 		}
 		res = fr
 	}
-	return res
+	return NewMultiset(res), nil
 }
 
 func (p Tuple) Unify(net *Net, v *Value, venv VEnv) (int, error) {
-	// v should be a tuple of size equal to p. We cannot detect this without
-	// starting to explore v.
+	// v should be a tuple with as many components as p, once nested tuples
+	// are flattened. We cannot detect this without starting to explore v.
 	//
 	// We cannot assume that the tuple is of size at least 2, model
-	// UtilityControlRoom is a counter-example. But we may assume that tuples
-	// only contain constants. We never have tuples inside of tuples.
+	// UtilityControlRoom is a counter-example. A component of p can also be a
+	// tuple, in which case we use the width of its sort to find the matching
+	// components in v. When there are no nested product sorts in the net,
+	// each component of p matches exactly one component of v.
 	vv := v
 	for _, e := range p {
-		if vv == nil {
+		var c, rest *Value
+		if net.nested {
+			c, rest = net.split(vv, net.widthOf(e))
+		} else if vv != nil {
+			c, rest = net.unique(Value{Head: vv.Head}), vv.Tail
+		}
+		if c == nil {
 			return -1, fmt.Errorf("matching tuple value is shorter than tuple expression in Unify")
 		}
-		mult, err := e.Unify(net, net.Unique[Value{Head: vv.Head, Tail: nil}], venv)
+		mult, err := e.Unify(net, c, venv)
 		if err != nil {
 			return -1, err
 		}
+		if mult < 0 {
+			return -1, fmt.Errorf("negative multiplicity during unification of tuple")
+		}
 		if mult == 0 {
 			// unification fails.
 			return 0, nil
@@ -232,7 +232,7 @@ func (p Tuple) Unify(net *Net, v *Value, venv VEnv) (int, error) {
 		if mult != 1 {
 			return -1, fmt.Errorf("matching multiplicity different from 1 during unification of tuple")
 		}
-		vv = vv.Tail
+		vv = rest
 	}
 	if vv != nil {
 		return -1, fmt.Errorf("matching tuple value is longer than tuple expression in Unify")
@@ -255,6 +255,8 @@ func (p OP) String() string {
 		return " and "
 	case OR:
 		return " or "
+	case IMPLY:
+		return " => "
 	case EQ:
 		return " = "
 	case INEQ:
@@ -267,11 +269,24 @@ func (p OP) String() string {
 		return " > "
 	case GREATTHANEQ:
 		return " >= "
+	case ADDITION:
+		return " + "
+	case SUBTRACTION:
+		return " - "
+	case MULT:
+		return " * "
+	case DIV:
+		return " / "
+	case MOD:
+		return " % "
 	}
 	return ""
 }
 
 func (p Operation) String() string {
+	if p.Op == NOT {
+		return "not " + p.Elem[0].String()
+	}
 	return util.ZipPrint(p.Elem, "(", ")", p.Op.String())
 }
 
@@ -279,47 +294,150 @@ func (p Operation) AddEnv(env Env) Env {
 	return multaddEnv(p.Elem, env)
 }
 
-func (p Operation) Eval(net *Net, venv VEnv) []Atom {
-	log.Panic("Eval not authorized on Operation")
-	panic("")
+// Eval returns the value of the condition in the bool sort. It returns
+// ErrUndefined when the condition is undefined.
+func (p Operation) Eval(net *Net, venv VEnv) (Multiset, error) {
+	b, err := p.check(net, venv)
+	if err != nil {
+		return nil, err
+	}
+	return []Atom{{net.BoolValue(b), 1}}, nil
 }
 
+// Unify is used when a boolean expression occurs in an arc pattern, for
+// instance in a tuple component. We can only unify ground expressions, or the
+// negation of an expression that can be unified.
 func (p Operation) Unify(net *Net, v *Value, venv VEnv) (int, error) {
-	return -1, fmt.Errorf("try to apply Unify to an <Operation> expression")
+	if isGround(p, venv) {
+		return unifyGround(net, p, v, venv)
+	}
+	if p.Op == NOT {
+		switch v {
+		case net.vtrue:
+			return p.Elem[0].Unify(net, net.vfalse, venv)
+		case net.vfalse:
+			return p.Elem[0].Unify(net, net.vtrue, venv)
+		}
+		return 0, nil
+	}
+	return -1, Unsupported("unification of boolean expression %s", p)
 }
 
-// OK returns whether the condition evaluates to true.
-func (p Operation) OK(net *Net, venv VEnv) bool {
+// OK returns whether the condition evaluates to true. An undefined condition,
+// for instance when comparing the successor of the last value of a finite
+// enumeration, is false.
+func (p Operation) OK(net *Net, venv VEnv) (bool, error) {
+	b, err := p.check(net, venv)
+	return b, ignoreUndefined(err)
+}
+
+// check is like OK, but returns ErrUndefined when the condition is undefined.
+// Boolean operators are evaluated lazily, from left to right, and we stop at
+// the first error. Hence undefinedness propagates through boolean operators:
+// the negation of an undefined comparison is also undefined, and not true.
+func (p Operation) check(net *Net, venv VEnv) (bool, error) {
 	switch p.Op {
 	case NIL:
-		return true
+		return true, nil
 	case AND:
 		for _, c := range p.Elem {
-			if !c.(Operation).OK(net, venv) {
-				return false
+			if b, err := holds(net, c, venv); err != nil || !b {
+				return false, err
 			}
 		}
-		return true
+		return true, nil
 	case OR:
 		for _, c := range p.Elem {
-			if c.(Operation).OK(net, venv) {
-				return true
+			if b, err := holds(net, c, venv); err != nil || b {
+				return b && err == nil, err
 			}
 		}
-		return false
+		return false, nil
+	case NOT:
+		b, err := holds(net, p.Elem[0], venv)
+		return !b && err == nil, err
+	case IMPLY:
+		b, err := holds(net, p.Elem[0], venv)
+		if err != nil || !b {
+			return err == nil, err
+		}
+		return holds(net, p.Elem[1], venv)
 	default:
-		v1 := p.Elem[0].Eval(net, venv)
-		v2 := p.Elem[1].Eval(net, venv)
+		if len(p.Elem) != 2 {
+			return false, evalError("comparison %s should have two operands", p)
+		}
+		v1, err := net.evalColor(p.Elem[0], venv)
+		if err != nil {
+			return false, err
+		}
+		v2, err := net.evalColor(p.Elem[1], venv)
+		if err != nil {
+			return false, err
+		}
 		if len(v1) == 0 || len(v2) == 0 {
-			return false
+			return false, nil
 		}
 		if len(v1) > 1 || len(v2) > 1 {
-			log.Panic("problem in conditional, too many results")
+			return false, evalError("operand of comparison %s is not a single value", p)
 		}
 		return net.compareExp(v1[0].Value, v2[0].Value, p.Op)
 	}
 }
 
+// evalColor evaluates an operand of a comparison. This is like Eval, except
+// for the name of a partition element, which denotes the element itself and
+// not the multiset of its members.
+func (net *Net) evalColor(e Expression, venv VEnv) (Multiset, error) {
+	if c, ok := e.(Constant); ok {
+		if pval, found := net.parts[string(c)]; found {
+			return []Atom{{pval, 1}}, nil
+		}
+	}
+	return e.Eval(net, venv)
+}
+
+// holds returns whether the boolean expression e evaluates to true. The
+// expression can be an Operation but also a variable or a constant of the bool
+// sort. It returns ErrUndefined when e is undefined.
+func holds(net *Net, e Expression, venv VEnv) (bool, error) {
+	if op, ok := e.(Operation); ok {
+		return op.check(net, venv)
+	}
+	v, err := e.Eval(net, venv)
+	return len(v) == 1 && v[0].Value == net.vtrue && err == nil, err
+}
+
+// ignoreUndefined returns nil if err is ErrUndefined, and err otherwise. It is
+// used when an undefined value simply means that a condition is false.
+func ignoreUndefined(err error) error {
+	if errors.Is(err, ErrUndefined) {
+		return nil
+	}
+	return err
+}
+
+// ----------------------------------------------------------------------
+
+// BoolConstant is the type of boolean constants.
+type BoolConstant bool
+
+func (p BoolConstant) String() string {
+	return strconv.FormatBool(bool(p))
+}
+
+func (p BoolConstant) AddEnv(env Env) Env { return env }
+
+func (p BoolConstant) Eval(net *Net, venv VEnv) (Multiset, error) {
+	return []Atom{{net.BoolValue(bool(p)), 1}}, nil
+}
+
+func (p BoolConstant) Unify(net *Net, v *Value, venv VEnv) (int, error) {
+	if net.BoolValue(bool(p)) == v {
+		return 1, nil
+	}
+	return 0, nil
+}
+
 // ----------------------------------------------------------------------
 
 // Constant is the type of constant expressions.
@@ -331,21 +449,21 @@ func (p Constant) String() string {
 
 func (p Constant) AddEnv(env Env) Env { return env }
 
-func (p Constant) Eval(net *Net, venv VEnv) []Atom {
+func (p Constant) Eval(net *Net, venv VEnv) (Multiset, error) {
 	pval, found := net.order[string(p)]
 	if !found {
 		// for the special case of partition ; the only example is VehicularWifi
 		f, wfound := net.World[string(p)]
 		if !wfound {
-			log.Panicf("identifier %s is not a constant or a known type", string(p))
+			return nil, evalError("identifier %s is not a constant or a known type", string(p))
 		}
 		m := make([]Atom, len(f))
 		for i := range f {
 			m[i] = Atom{f[i], 1}
 		}
-		return m
+		return NewMultiset(m), nil
 	}
-	return []Atom{{pval, 1}}
+	return []Atom{{pval, 1}}, nil
 }
 
 func (p Constant) Unify(net *Net, v *Value, venv VEnv) (int, error) {
@@ -353,7 +471,7 @@ func (p Constant) Unify(net *Net, v *Value, venv VEnv) (int, error) {
 	// in p.
 	pval, found := net.order[string(p)]
 	if !found {
-		return -1, fmt.Errorf("bad identifier " + string(p) + " in constant unification")
+		return -1, evalError("bad identifier %s in constant unification", string(p))
 	}
 	if pval.Head == v.Head {
 		return 1, nil
@@ -380,15 +498,19 @@ func (p FIRConstant) String() string {
 
 func (p FIRConstant) AddEnv(env Env) Env { return env }
 
-func (p FIRConstant) Eval(net *Net, venv VEnv) []Atom {
-	return []Atom{{net.order[p.stringify()], 1}}
+func (p FIRConstant) Eval(net *Net, venv VEnv) (Multiset, error) {
+	pval, found := net.order[p.stringify()]
+	if !found {
+		return nil, evalError("FIRconstant %s not found", p.stringify())
+	}
+	return []Atom{{pval, 1}}, nil
 }
 
 func (p FIRConstant) Unify(net *Net, v *Value, venv VEnv) (int, error) {
 	// The two values should be equal. We do not expect to find a type constant in
 	pval, found := net.order[p.stringify()]
 	if !found {
-		return -1, fmt.Errorf("FIRconstant " + p.stringify() + " not found")
+		return -1, evalError("FIRconstant %s not found", p.stringify())
 	}
 	if pval.Head == v.Head {
 		return 1, nil
@@ -398,6 +520,149 @@ func (p FIRConstant) Unify(net *Net, v *Value, venv VEnv) (int, error) {
 
 // ----------------------------------------------------------------------
 
+// IntConstant is the type of integer constants used as a color, for instance
+// in a tuple or in an arithmetic expression.
+type IntConstant int
+
+func (p IntConstant) String() string {
+	return strconv.Itoa(int(p))
+}
+
+func (p IntConstant) AddEnv(env Env) Env { return env }
+
+func (p IntConstant) Eval(net *Net, venv VEnv) (Multiset, error) {
+	return []Atom{{net.IntValue(int(p)), 1}}, nil
+}
+
+func (p IntConstant) Unify(net *Net, v *Value, venv VEnv) (int, error) {
+	if net.IntValue(int(p)) == v {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// ----------------------------------------------------------------------
+
+// Arithmetic is the type of arithmetic operations (addition, subtraction,
+// mult, div and mod) over integers. Like with Operation, the operation is
+// applied to a slice of expressions, from left to right.
+type Arithmetic struct {
+	Op   OP
+	Elem []Expression
+}
+
+func (p Arithmetic) String() string {
+	return util.ZipPrint(p.Elem, "(", ")", p.Op.String())
+}
+
+func (p Arithmetic) AddEnv(env Env) Env {
+	return multaddEnv(p.Elem, env)
+}
+
+// Eval returns nil if one of the operands is not an integer, and ErrUndefined
+// in case of a division by zero.
+func (p Arithmetic) Eval(net *Net, venv VEnv) (Multiset, error) {
+	res, ok, err := p.eval(net, venv)
+	if !ok {
+		return nil, err
+	}
+	return []Atom{{net.IntValue(res), 1}}, nil
+}
+
+func (p Arithmetic) eval(net *Net, venv VEnv) (int, bool, error) {
+	var res int
+	for i, e := range p.Elem {
+		n, ok, err := evalInt(net, e, venv)
+		if !ok {
+			return 0, false, err
+		}
+		if i == 0 {
+			res = n
+			continue
+		}
+		switch p.Op {
+		case ADDITION:
+			res += n
+		case SUBTRACTION:
+			res -= n
+		case MULT:
+			res *= n
+		case DIV, MOD:
+			if n == 0 {
+				return 0, false, ErrUndefined
+			}
+			if p.Op == DIV {
+				res /= n
+			} else {
+				res %= n
+			}
+		}
+	}
+	return res, true, nil
+}
+
+// evalInt returns the integer value of expression e. The boolean is false if e
+// does not evaluate to a single integer, or if there is an error.
+func evalInt(net *Net, e Expression, venv VEnv) (int, bool, error) {
+	m, err := e.Eval(net, venv)
+	if err != nil || len(m) != 1 {
+		return 0, false, err
+	}
+	n, ok := net.IntOf(m[0].Value)
+	return n, ok, nil
+}
+
+// Unify evaluates the expression when all its variables are bound. Otherwise,
+// we can only solve the case of an addition or subtraction with two operands,
+// where one of them is ground. For instance x + 1 matches v if and only if x
+// matches v - 1.
+func (p Arithmetic) Unify(net *Net, v *Value, venv VEnv) (int, error) {
+	if isGround(p, venv) {
+		return unifyGround(net, p, v, venv)
+	}
+	n, ok := net.IntOf(v)
+	if !ok {
+		return 0, nil
+	}
+	if len(p.Elem) != 2 || (p.Op != ADDITION && p.Op != SUBTRACTION) {
+		return -1, Unsupported("unification of arithmetic expression %s", p)
+	}
+	left, right := p.Elem[0], p.Elem[1]
+	switch {
+	case isGround(right, venv):
+		c, ok, err := evalInt(net, right, venv)
+		if !ok {
+			return 0, ignoreUndefined(err)
+		}
+		if p.Op == ADDITION {
+			return left.Unify(net, net.IntValue(n-c), venv)
+		}
+		return left.Unify(net, net.IntValue(n+c), venv)
+	case isGround(left, venv):
+		c, ok, err := evalInt(net, left, venv)
+		if !ok {
+			return 0, ignoreUndefined(err)
+		}
+		if p.Op == ADDITION {
+			return right.Unify(net, net.IntValue(n-c), venv)
+		}
+		return right.Unify(net, net.IntValue(c-n), venv)
+	}
+	return -1, Unsupported("unification of arithmetic expression %s", p)
+}
+
+// isGround reports whether all the variables in e are bound in venv.
+func isGround(e Expression, venv VEnv) bool {
+	for _, v := range e.AddEnv(nil) {
+		if venv[v] == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// ----------------------------------------------------------------------
+
 // Var is the type of variables.
 type Var string
 
@@ -409,26 +674,26 @@ func (p Var) AddEnv(env Env) Env {
 	return insertEnv(env, p)
 }
 
-func (p Var) Eval(net *Net, venv VEnv) []Atom {
-	return []Atom{{venv[string(p)], 1}}
+func (p Var) Eval(net *Net, venv VEnv) (Multiset, error) {
+	v := venv[string(p)]
+	if v == nil {
+		return nil, evalError("variable %s is not bound", string(p))
+	}
+	return []Atom{{v, 1}}, nil
 }
 
 func (p Var) Unify(net *Net, v *Value, venv VEnv) (int, error) {
-	// We expect that value v is a constant (and not a tuple)
-	if v.Tail != nil {
-		return -1, fmt.Errorf("value is not atomic in unification of Var")
-	}
+	// v can be a tuple when p is a variable of a product sort
 	vv, ok := venv[string(p)]
-	// if variable p is not set in venv, we add it
 	if !ok {
-		panic("you did a bad job in <Var>.Unify!")
+		return -1, evalError("variable %s is not in the environment", string(p))
 	}
 	if vv == nil {
 		venv[string(p)] = v
 		return 1, nil
 	}
 	// otherwise we need to check that the values are the same
-	if vv.Head == v.Head {
+	if vv == v {
 		return 1, nil
 	}
 	return 0, nil
@@ -445,8 +710,8 @@ func (p Dot) String() string {
 
 func (p Dot) AddEnv(env Env) Env { return env }
 
-func (p Dot) Eval(net *Net, venv VEnv) []Atom {
-	return []Atom{{net.vdot, 1}}
+func (p Dot) Eval(net *Net, venv VEnv) (Multiset, error) {
+	return []Atom{{net.vdot, 1}}, nil
 }
 
 func (p Dot) Unify(net *Net, v *Value, venv VEnv) (int, error) {
@@ -458,9 +723,12 @@ func (p Dot) Unify(net *Net, v *Value, venv VEnv) (int, error) {
 
 // ----------------------------------------------------------------------
 
-// Successor is the type of successor and predecessor operations.
+// Successor is the type of successor and predecessor operations. The
+// operand can be any expression denoting a value of an enumeration, like a
+// variable or a constant. We group nested successors (or nested predecessors)
+// and use the sign of Incr to tell them apart.
 type Successor struct {
-	Var
+	Expression
 	Incr int
 }
 
@@ -471,27 +739,42 @@ func (p Successor) String() string {
 	} else {
 		mod = "--" + strconv.Itoa(-p.Incr)
 	}
-	return string(p.Var) + mod
+	return p.Expression.String() + mod
 }
 
-func (p Successor) AddEnv(env Env) Env {
-	return insertEnv(env, p.Var)
-}
-
-func (p Successor) Eval(net *Net, venv VEnv) []Atom {
-	c := venv[string(p.Var)]
-	res := net.Next(p.Incr, c)
-	if res == nil {
-		return nil
+// Eval returns ErrUndefined when the successor of one of the values is
+// undefined, for instance after the last constant of a finite enumeration, so
+// that a binding using it is invalid.
+func (p Successor) Eval(net *Net, venv VEnv) (Multiset, error) {
+	m, err := p.Expression.Eval(net, venv)
+	if err != nil {
+		return nil, err
 	}
-	return []Atom{{res, 1}}
+	res := make([]Atom, len(m))
+	for i, a := range m {
+		v := net.Next(p.Incr, a.Value)
+		if v == nil {
+			return nil, ErrUndefined
+		}
+		res[i] = Atom{v, a.Mult}
+	}
+	// the successor of the last constant is the first one, so we need to sort
+	// the result again
+	return NewMultiset(res), nil
 }
 
 // Unification with a successor occurs in models BART and TokenRing. We use the
-// fact that var++k matches val if and only if var matches val--k.
+// fact that e++k matches val if and only if e matches val--k, when it is
+// defined.
 func (p Successor) Unify(net *Net, v *Value, venv VEnv) (int, error) {
+	if isGround(p, venv) {
+		return unifyGround(net, p, v, venv)
+	}
 	vv := net.Next(-p.Incr, v)
-	return p.Var.Unify(net, vv, venv)
+	if vv == nil {
+		return 0, nil
+	}
+	return p.Expression.Unify(net, vv, venv)
 }
 
 // ----------------------------------------------------------------------
@@ -511,25 +794,208 @@ func (p Numberof) AddEnv(env Env) Env {
 	return p.Expression.AddEnv(env)
 }
 
-func (p Numberof) Eval(net *Net, venv VEnv) []Atom {
-	m := p.Expression.Eval(net, venv)
-	for i := range m {
-		m[i].Mult = p.Mult
-	}
-	return m
+func (p Numberof) Eval(net *Net, venv VEnv) (Multiset, error) {
+	m, err := p.Expression.Eval(net, venv)
+	return m.Scale(p.Mult), err
 }
 
-// We can return a negative number of
+// Unify multiplies the number of copies matched by Expression with Mult. A
+// negative result means that the pattern is not well-formed, and is an error.
 func (p Numberof) Unify(net *Net, v *Value, venv VEnv) (int, error) {
 	val, err := p.Expression.Unify(net, v, venv)
 	if err != nil {
 		return -1, err
 	}
+	if val < 0 || p.Mult < 0 {
+		return -1, fmt.Errorf("negative multiplicity during unification of %s", p)
+	}
 	return p.Mult * val, nil
 }
 
 // ----------------------------------------------------------------------
 
+// ScalarProduct is the type of scalarproduct expressions, where the
+// multiplicities of a multiset are multiplied by an integer expression, Mult.
+// We also use it for numberof expressions when the multiplicity is not a
+// constant.
+type ScalarProduct struct {
+	Mult Expression
+	Expression
+}
+
+func (p ScalarProduct) String() string {
+	return p.Mult.String() + "*" + p.Expression.String()
+}
+
+func (p ScalarProduct) AddEnv(env Env) Env {
+	return p.Expression.AddEnv(p.Mult.AddEnv(env))
+}
+
+// Eval returns nil if the multiplicity does not evaluate to an integer, and
+// ErrUndefined if it is negative.
+func (p ScalarProduct) Eval(net *Net, venv VEnv) (Multiset, error) {
+	n, ok, err := evalInt(net, p.Mult, venv)
+	if !ok {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, ErrUndefined
+	}
+	m, err := p.Expression.Eval(net, venv)
+	return m.Scale(n), err
+}
+
+// Unify is like with Numberof, but the multiplicity should be ground.
+func (p ScalarProduct) Unify(net *Net, v *Value, venv VEnv) (int, error) {
+	if !isGround(p.Mult, venv) {
+		return -1, Unsupported("unification of scalar product %s with a free multiplicity", p)
+	}
+	n, ok, err := evalInt(net, p.Mult, venv)
+	if !ok || n < 0 {
+		return 0, ignoreUndefined(err)
+	}
+	val, err := p.Expression.Unify(net, v, venv)
+	if err != nil {
+		return -1, err
+	}
+	return n * val, nil
+}
+
+// ----------------------------------------------------------------------
+
+// PartitionElementOf is the type of partitionelementof expressions. It returns
+// the element of partition Partition that contains the value of Expression.
+type PartitionElementOf struct {
+	Partition string
+	Expression
+}
+
+func (p PartitionElementOf) String() string {
+	return p.Partition + "(" + p.Expression.String() + ")"
+}
+
+// Eval returns nil if Expression does not evaluate to a single value of the
+// partitioned sort.
+func (p PartitionElementOf) Eval(net *Net, venv VEnv) (Multiset, error) {
+	v, err := p.Expression.Eval(net, venv)
+	if err != nil || len(v) != 1 {
+		return nil, err
+	}
+	pval, found := net.partitions[p.Partition][v[0].Value]
+	if !found {
+		return nil, nil
+	}
+	return []Atom{{pval, 1}}, nil
+}
+
+func (p PartitionElementOf) Unify(net *Net, v *Value, venv VEnv) (int, error) {
+	return unifyGround(net, p, v, venv)
+}
+
+// ----------------------------------------------------------------------
+
+// Cardinality is the type of cardinality expressions. It returns the number of
+// elements in a multiset, as an integer value.
+type Cardinality struct {
+	Expression
+}
+
+func (p Cardinality) String() string {
+	return "|" + p.Expression.String() + "|"
+}
+
+func (p Cardinality) Eval(net *Net, venv VEnv) (Multiset, error) {
+	m, err := p.Expression.Eval(net, venv)
+	if err != nil {
+		return nil, err
+	}
+	return []Atom{{net.IntValue(m.Card()), 1}}, nil
+}
+
+func (p Cardinality) Unify(net *Net, v *Value, venv VEnv) (int, error) {
+	return unifyGround(net, p, v, venv)
+}
+
+// CardinalityOf is the type of cardinalityof expressions. It returns the
+// multiplicity of a color, Color, in a multiset, Multiset, as an integer value.
+type CardinalityOf struct {
+	Multiset Expression
+	Color    Expression
+}
+
+func (p CardinalityOf) String() string {
+	return p.Multiset.String() + "[" + p.Color.String() + "]"
+}
+
+func (p CardinalityOf) AddEnv(env Env) Env {
+	return p.Color.AddEnv(p.Multiset.AddEnv(env))
+}
+
+// Eval returns nil if Color does not evaluate to a single value.
+func (p CardinalityOf) Eval(net *Net, venv VEnv) (Multiset, error) {
+	c, err := p.Color.Eval(net, venv)
+	if err != nil || len(c) != 1 {
+		return nil, err
+	}
+	m, err := p.Multiset.Eval(net, venv)
+	if err != nil {
+		return nil, err
+	}
+	return []Atom{{net.IntValue(m.Mult(c[0].Value)), 1}}, nil
+}
+
+func (p CardinalityOf) Unify(net *Net, v *Value, venv VEnv) (int, error) {
+	return unifyGround(net, p, v, venv)
+}
+
+// Contains is the type of contains expressions. It is a condition that holds
+// when the first multiset includes the second one.
+type Contains []Expression
+
+func (p Contains) String() string {
+	return util.ZipPrint(p, "(", ")", " contains ")
+}
+
+func (p Contains) AddEnv(env Env) Env {
+	return multaddEnv(p, env)
+}
+
+func (p Contains) Eval(net *Net, venv VEnv) (Multiset, error) {
+	m0, err := p[0].Eval(net, venv)
+	if err != nil {
+		return nil, err
+	}
+	m1, err := p[1].Eval(net, venv)
+	if err != nil {
+		return nil, err
+	}
+	return []Atom{{net.BoolValue(m0.Includes(m1)), 1}}, nil
+}
+
+func (p Contains) Unify(net *Net, v *Value, venv VEnv) (int, error) {
+	return unifyGround(net, p, v, venv)
+}
+
+// unifyGround is used for expressions that can only be unified when all their
+// variables are bound. In this case, we simply compare v with the result of
+// Eval.
+func unifyGround(net *Net, e Expression, v *Value, venv VEnv) (int, error) {
+	if !isGround(e, venv) {
+		return -1, Unsupported("unification of expression %s with free variables", e)
+	}
+	m, err := e.Eval(net, venv)
+	if err != nil {
+		// an undefined pattern matches no value
+		return 0, ignoreUndefined(err)
+	}
+	if len(m) == 1 && m[0].Value == v {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// ----------------------------------------------------------------------
+
 func multaddEnv(ee []Expression, env Env) Env {
 	for _, v := range ee {
 		env = v.AddEnv(env)
@@ -0,0 +1,207 @@
+// Copyright 2023. Silvano DAL ZILIO (LAAS-CNRS). All rights reserved. Use of
+// this source code is governed by the GNU Affero license that can be found in
+// the LICENSE file.
+
+package pnml
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sort"
+)
+
+// Multiset is the type of multisets of values. A Multiset is always in
+// canonical form: atoms are sorted in the order of ValueIsLess, each value
+// occurs at most once and all multiplicities are positive. Hence two equal
+// multisets have the same representation, which is why most operations can be
+// computed in a single pass over their operands.
+//
+// We never modify a Multiset in place once it is built. Operations always
+// return a fresh slice, or one of their operands.
+type Multiset []Atom
+
+// NewMultiset returns the multiset with the values in atoms, merging
+// duplicates and removing values with a null (or negative) multiplicity. The
+// storage of atoms is reused for the result.
+func NewMultiset(atoms []Atom) Multiset {
+	sort.SliceStable(atoms, func(a, b int) bool { return ValueIsLess(atoms[a].Value, atoms[b].Value) })
+	j := 0
+	for i := 0; i < len(atoms); i++ {
+		if j != 0 && atoms[i].Value == atoms[j-1].Value {
+			atoms[j-1].Mult += atoms[i].Mult
+			continue
+		}
+		if j != 0 && atoms[j-1].Mult <= 0 {
+			j--
+		}
+		atoms[j] = atoms[i]
+		j++
+	}
+	if j != 0 && atoms[j-1].Mult <= 0 {
+		j--
+	}
+	if j == 0 {
+		return nil
+	}
+	return Multiset(atoms[:j])
+}
+
+// Card returns the cardinality of m, that is the sum of its multiplicities.
+func (m Multiset) Card() int {
+	s := 0
+	for _, a := range m {
+		s += a.Mult
+	}
+	return s
+}
+
+// Mult returns the multiplicity of value v in m, which is 0 if v is not in m.
+func (m Multiset) Mult(v *Value) int {
+	if i, ok := m.index(v); ok {
+		return m[i].Mult
+	}
+	return 0
+}
+
+// index returns the position of v in m, or the position where it should be
+// inserted when v is not in m.
+func (m Multiset) index(v *Value) (int, bool) {
+	i := sort.Search(len(m), func(i int) bool { return !ValueIsLess(m[i].Value, v) })
+	return i, i < len(m) && m[i].Value == v
+}
+
+// Equal reports whether m and m2 are equal.
+func (m Multiset) Equal(m2 Multiset) bool {
+	if len(m) != len(m2) {
+		return false
+	}
+	for i := range m {
+		if m[i] != m2[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Union returns the sum of m and m2, where multiplicities are added.
+func (m Multiset) Union(m2 Multiset) Multiset {
+	if len(m2) == 0 {
+		return m
+	}
+	if len(m) == 0 {
+		return m2
+	}
+	res := make(Multiset, 0, len(m)+len(m2))
+	i, j := 0, 0
+	for i < len(m) && j < len(m2) {
+		switch {
+		case m[i].Value == m2[j].Value:
+			res = append(res, Atom{m[i].Value, m[i].Mult + m2[j].Mult})
+			i++
+			j++
+		case ValueIsLess(m[i].Value, m2[j].Value):
+			res = append(res, m[i])
+			i++
+		default:
+			res = append(res, m2[j])
+			j++
+		}
+	}
+	res = append(res, m[i:]...)
+	return append(res, m2[j:]...)
+}
+
+// Diff returns the difference between m and m2. Multiplicities are truncated,
+// meaning that values with more copies in m2 than in m are not in the result.
+func (m Multiset) Diff(m2 Multiset) Multiset {
+	if len(m2) == 0 || len(m) == 0 {
+		return m
+	}
+	res := make(Multiset, 0, len(m))
+	i, j := 0, 0
+	for i < len(m) && j < len(m2) {
+		switch {
+		case m[i].Value == m2[j].Value:
+			if n := m[i].Mult - m2[j].Mult; n > 0 {
+				res = append(res, Atom{m[i].Value, n})
+			}
+			i++
+			j++
+		case ValueIsLess(m[i].Value, m2[j].Value):
+			res = append(res, m[i])
+			i++
+		default:
+			j++
+		}
+	}
+	res = append(res, m[i:]...)
+	if len(res) == 0 {
+		return nil
+	}
+	return res
+}
+
+// Includes reports whether m2 is included in m, meaning that every value has
+// at least as many copies in m than in m2.
+func (m Multiset) Includes(m2 Multiset) bool {
+	if len(m2) > len(m) {
+		return false
+	}
+	i := 0
+	for _, a := range m2 {
+		for i < len(m) && ValueIsLess(m[i].Value, a.Value) {
+			i++
+		}
+		if i == len(m) || m[i].Value != a.Value || m[i].Mult < a.Mult {
+			return false
+		}
+		i++
+	}
+	return true
+}
+
+// Scale returns the scalar product of m by n. The result is empty when n is
+// not positive.
+func (m Multiset) Scale(n int) Multiset {
+	if n <= 0 || len(m) == 0 {
+		return nil
+	}
+	if n == 1 {
+		return m
+	}
+	res := make(Multiset, len(m))
+	for i, a := range m {
+		res[i] = Atom{a.Value, a.Mult * n}
+	}
+	return res
+}
+
+// Hash returns a hash of m. It only depends on the values in m, and not on the
+// addresses of their representation: constants are identified by their
+// position in the declarations of the net, and integers by their value. Hence
+// the hash is the same for every instance of a given net.
+func (m Multiset) Hash() uint64 {
+	h := fnv.New64a()
+	h.Write(m.appendKey(nil))
+	return h.Sum64()
+}
+
+// appendKey appends an encoding of m to b. Two multisets have the same
+// encoding if and only if they are equal.
+func (m Multiset) appendKey(b []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(m)))
+	for _, a := range m {
+		b = binary.AppendVarint(b, int64(a.Mult))
+		for v := a.Value; v != nil; v = v.Tail {
+			if v.Head < 0 {
+				b = binary.AppendUvarint(b, 2)
+				b = binary.AppendVarint(b, int64(headInt(v.Head)))
+				continue
+			}
+			b = binary.AppendUvarint(b, 1)
+			b = binary.AppendVarint(b, int64(v.Head))
+		}
+		b = binary.AppendUvarint(b, 0)
+	}
+	return b
+}
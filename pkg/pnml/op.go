@@ -17,6 +17,13 @@ const (
 	GREATTHANEQ
 	OR
 	AND
+	NOT
+	IMPLY
+	ADDITION
+	SUBTRACTION
+	MULT
+	DIV
+	MOD
 )
 
 // ----------------------------------------------------------------------
@@ -31,6 +38,8 @@ const (
 	FINTRANGE
 	PROD
 	NUMERIC
+	BOOL
+	ALIAS
 )
 
 // ----------------------------------------------------------------------
@@ -41,18 +50,32 @@ func getpOP(s string) OP {
 		return EQ
 	case "inequality":
 		return INEQ
-	case "lessthan":
+	case "lessthan", "lt", "ltp":
 		return LESSTHAN
-	case "lessthanorequal":
+	case "lessthanorequal", "leq":
 		return LESSTHANEQ
-	case "greaterthan":
+	case "greaterthan", "gt", "gtp":
 		return GREATTHAN
-	case "greaterthanorequal":
+	case "greaterthanorequal", "geq":
 		return GREATTHANEQ
 	case "or":
 		return OR
 	case "and":
 		return AND
+	case "not":
+		return NOT
+	case "imply":
+		return IMPLY
+	case "addition":
+		return ADDITION
+	case "subtraction":
+		return SUBTRACTION
+	case "mult":
+		return MULT
+	case "div":
+		return DIV
+	case "mod":
+		return MOD
 	}
 	panic("not an operation " + s)
 }
@@ -7,14 +7,13 @@ package pnml
 import (
 	"bytes"
 	"encoding/xml"
-	"errors"
 	"fmt"
 )
 
 func parseExprMult(d *xml.Decoder, acc []Expression) ([]Expression, error) {
 	res, err := parseExprElement(d)
 	if err != nil {
-		return nil, fmt.Errorf("error while parsing a sequence of elements; %s", err)
+		return nil, err
 	}
 	if res == nil {
 		return acc, nil
@@ -22,6 +21,29 @@ func parseExprMult(d *xml.Decoder, acc []Expression) ([]Expression, error) {
 	return parseExprMult(d, append(acc, res))
 }
 
+// parseColorMult is like parseExprMult but for elements that should denote a
+// color, like the components of a tuple or the operands of a comparison. In
+// this case, a numberconstant is an integer and not a multiplicity.
+func parseColorMult(d *xml.Decoder) ([]Expression, error) {
+	ee, err := parseExprMult(d, nil)
+	if err != nil {
+		return nil, err
+	}
+	for i := range ee {
+		ee[i] = asColor(ee[i])
+	}
+	return ee, nil
+}
+
+// asColor returns the integer constant corresponding to a numberconstant
+// without expression, and e otherwise.
+func asColor(e Expression) Expression {
+	if n, ok := e.(Numberof); ok && n.Expression == nil {
+		return IntConstant(n.Mult)
+	}
+	return e
+}
+
 func parseExprInner(decoder *xml.Decoder) (Expression, error) {
 	res, err := parseExprElement(decoder)
 	skipUntilEnd(decoder)
@@ -42,7 +64,17 @@ func skipUntilEnd(d *xml.Decoder) error {
 	return fmt.Errorf("expecting an xml.EndElement, found (%T) %v", t, t)
 }
 
+// malformed returns a SyntaxError at position (line, col) in the expression
+// being parsed. The position is relative to the start of the expression; it is
+// translated to a position in the file by parseExpression.
+func malformed(line, col int, format string, a ...interface{}) error {
+	return &SyntaxError{Kind: "PNML", Line: line, Col: col, Msg: fmt.Sprintf(format, a...)}
+}
+
 func parseExprElement(decoder *xml.Decoder) (Expression, error) {
+	// we record the position of the element before reading it, so that errors
+	// point to its start tag
+	line, col := decoder.InputPos()
 	t, _ := decoder.Token()
 	if t == nil {
 		return nil, nil
@@ -65,17 +97,25 @@ func parseExprElement(decoder *xml.Decoder) (Expression, error) {
 			if s, ok := res.(Constant); ok {
 				return All(s), nil
 			}
-			return nil, errors.New("malformed PNML, an all element should contain usersort")
+			return nil, malformed(line, col, "an all element should contain usersort")
 		case "usersort":
 			var s Type
-			decoder.DecodeElement(&s, &se)
+			if err := decoder.DecodeElement(&s, &se); err != nil {
+				return nil, malformed(line, col, "bad <%s>: %s", se.Name.Local, err)
+			}
 			return Constant(s.ID), nil
 		case "useroperator":
 			var s Type
-			decoder.DecodeElement(&s, &se)
+			if err := decoder.DecodeElement(&s, &se); err != nil {
+				return nil, malformed(line, col, "bad <%s>: %s", se.Name.Local, err)
+			}
 			return Constant(s.ID), nil
+		case "integer", "natural", "positive":
+			// built-in sorts of the Integers extension
+			skipUntilEnd(decoder)
+			return Constant(se.Name.Local), nil
 		case "tuple":
-			ee, err := parseExprMult(decoder, nil)
+			ee, err := parseColorMult(decoder)
 			if err != nil {
 				return nil, err
 			}
@@ -105,21 +145,52 @@ func parseExprElement(decoder *xml.Decoder) (Expression, error) {
 			if err != nil {
 				return nil, err
 			}
-			if r, ok := res.(Successor); ok {
-				return Successor{Var: r.Var, Incr: r.Incr + inc}, nil
+			if res == nil {
+				return nil, malformed(line, col, "<%s> without operand", se.Name.Local)
 			}
-			if r, ok := res.(Var); ok {
-				return Successor{Var: r, Incr: inc}, nil
+			// we can only group successive operations in the same direction,
+			// since x++1--1 is undefined when x is the last constant of a
+			// finite enumeration
+			if r, ok := res.(Successor); ok && (r.Incr > 0) == (inc > 0) {
+				return Successor{Expression: r.Expression, Incr: r.Incr + inc}, nil
 			}
-			return nil, errors.New("we only support successor and predecessor on variables")
-		case "or", "and", "equality", "inequality",
+			return Successor{Expression: asColor(res), Incr: inc}, nil
+		case "or", "and", "not", "imply":
+			ee, err := parseColorMult(decoder)
+			if err != nil {
+				return nil, err
+			}
+			return Operation{Op: getpOP(se.Name.Local), Elem: ee}, nil
+		case "equality", "inequality",
 			"lessthanorequal", "lessthan",
-			"greaterthan", "greaterthanorequal":
-			ee, err := parseExprMult(decoder, nil)
+			"greaterthan", "greaterthanorequal",
+			"lt", "leq", "gt", "geq",
+			"ltp", "gtp":
+			// partition elements are compared using their position in the
+			// partition, which is also the order of their values
+			ee, err := parseColorMult(decoder)
 			if err != nil {
 				return nil, err
 			}
 			return Operation{Op: getpOP(se.Name.Local), Elem: ee}, nil
+		case "addition", "subtraction", "mult", "div", "mod":
+			ee, err := parseColorMult(decoder)
+			if err != nil {
+				return nil, err
+			}
+			if len(ee) < 2 {
+				return nil, malformed(line, col, "arithmetic operation <%s> needs two operands", se.Name.Local)
+			}
+			return Arithmetic{Op: getpOP(se.Name.Local), Elem: ee}, nil
+		case "bool":
+			skipUntilEnd(decoder)
+			return Constant("bool"), nil
+		case "booleanconstant":
+			var val BooleanConstant
+			if err := decoder.DecodeElement(&val, &se); err != nil {
+				return nil, malformed(line, col, "bad <%s>: %s", se.Name.Local, err)
+			}
+			return BoolConstant(val.Value), nil
 		case "dotconstant":
 			skipUntilEnd(decoder)
 			return Dot{}, nil
@@ -129,28 +200,88 @@ func parseExprElement(decoder *xml.Decoder) (Expression, error) {
 			// SimpleLoad, and lately on instance DotAndBoxes-COL-3 found in the
 			// MCC website. The same problem appears in files dot2.pnml and
 			// dot3.pnml of the benchmarks/simple folder.
-			res1, _ := parseExprElement(decoder)
+			res1, err := parseExprElement(decoder)
+			if err != nil {
+				return nil, err
+			}
+			res2, err := parseExprElement(decoder)
+			if err != nil {
+				return nil, err
+			}
 			if numb, ok := res1.(Numberof); ok {
-				res2, _ := parseExprElement(decoder)
 				skipUntilEnd(decoder)
-				numb.Expression = res2
+				numb.Expression = asColor(res2)
 				return numb, nil
 			}
-			res2, _ := parseExprElement(decoder)
 			if res2 == nil {
 				// it means that res1 was a value, not a numberconstant, and
 				// that the multiplicity was forgotten in the XML numberof
 				// element.
 				return Numberof{Expression: res1, Mult: 1}, nil
 			}
-			return nil, errors.New("malformed PNML in numberof, numberconstant is missing")
+			// otherwise the multiplicity is an expression, like a variable or
+			// an arithmetic operation
+			skipUntilEnd(decoder)
+			return ScalarProduct{Mult: res1, Expression: asColor(res2)}, nil
+		case "scalarproduct":
+			ee, err := parseExprMult(decoder, nil)
+			if err != nil {
+				return nil, err
+			}
+			if len(ee) != 2 {
+				return nil, malformed(line, col, "scalarproduct needs two operands")
+			}
+			return ScalarProduct{Mult: asColor(ee[0]), Expression: asColor(ee[1])}, nil
+		case "partitionelementof":
+			ref := ""
+			for _, a := range se.Attr {
+				if a.Name.Local == "refpartition" {
+					ref = a.Value
+				}
+			}
+			if ref == "" {
+				return nil, malformed(line, col, "partitionelementof without refpartition")
+			}
+			res, err := parseExprInner(decoder)
+			if err != nil {
+				return nil, err
+			}
+			return PartitionElementOf{Partition: ref, Expression: asColor(res)}, nil
+		case "cardinality":
+			res, err := parseExprInner(decoder)
+			if err != nil {
+				return nil, err
+			}
+			return Cardinality{res}, nil
+		case "cardinalityof":
+			ee, err := parseExprMult(decoder, nil)
+			if err != nil {
+				return nil, err
+			}
+			if len(ee) != 2 {
+				return nil, malformed(line, col, "cardinalityof needs a multiset and a color")
+			}
+			return CardinalityOf{Multiset: ee[0], Color: asColor(ee[1])}, nil
+		case "contains":
+			ee, err := parseExprMult(decoder, nil)
+			if err != nil {
+				return nil, err
+			}
+			if len(ee) != 2 {
+				return nil, malformed(line, col, "contains needs two operands")
+			}
+			return Contains(ee), nil
 		case "numberconstant":
 			var val NumberConstant
-			decoder.DecodeElement(&val, &se)
+			if err := decoder.DecodeElement(&val, &se); err != nil {
+				return nil, malformed(line, col, "bad <%s>: %s", se.Name.Local, err)
+			}
 			return Numberof{Expression: nil, Mult: val.Value}, nil
 		case "finiteintrangeconstant":
 			var val FIRangeConstant
-			decoder.DecodeElement(&val, &se)
+			if err := decoder.DecodeElement(&val, &se); err != nil {
+				return nil, malformed(line, col, "bad <%s>: %s", se.Name.Local, err)
+			}
 			return FIRConstant{
 				value: val.Value,
 				start: val.Range.Start,
@@ -158,22 +289,26 @@ func parseExprElement(decoder *xml.Decoder) (Expression, error) {
 			}, nil
 		case "variable":
 			var val Variable
-			decoder.DecodeElement(&val, &se)
+			if err := decoder.DecodeElement(&val, &se); err != nil {
+				return nil, malformed(line, col, "bad <%s>: %s", se.Name.Local, err)
+			}
 			return Var(val.RefVariable), nil
 		default:
-			return nil, errors.New("malformed PNML: unexpected Token <" + se.Name.Local + "> in parseExpr")
+			return nil, malformed(line, col, "unexpected element <%s>", se.Name.Local)
 		}
 	}
-	return nil, errors.New("malformed PNML: unexpected Token in parseExpr")
+	return nil, malformed(line, col, "unexpected token %T", t)
 }
 
 // parseExpression returns the PNML expression corresponding to the XML content
-// found in the provided byte slice.
-func parseExpression(b []byte) (Expression, error) {
-	if len(b) == 0 {
+// found in raw. Parameter id describes the enclosing place, transition or arc.
+// It is added, together with the position in the file, to syntax errors.
+func parseExpression(raw RawXML, id string) (Expression, error) {
+	if len(raw.InnerXML) == 0 {
 		return nil, nil
 	}
-	buff := bytes.NewBuffer(b)
+	buff := bytes.NewBuffer(raw.InnerXML)
 	decoder := xml.NewDecoder(buff)
-	return parseExprElement(decoder)
+	res, err := parseExprElement(decoder)
+	return res, raw.Locate(err, id)
 }
@@ -8,24 +8,41 @@ import (
 	"encoding/xml"
 	"fmt"
 	"io"
+	"strconv"
+	"strings"
 )
 
 // ----------------------------------------------------------------------
 
-// Next gives the ith successor (i can be negative) of the constant with id
-// name. We assume that the type of val is circular and do not check the
-// particular case where we should report overflows.
+// Next gives the ith successor (i can be negative) of value val in its sort.
+// We wrap around only for cyclic enumerations. The result is nil when we go
+// past the bounds of a finite enumeration or a finite int range, in which case
+// the successor is undefined, and for values that have no successor, like
+// booleans or tuples.
 func (e *Net) Next(i int, val *Value) *Value {
+	if n, ok := e.IntOf(val); ok {
+		return e.IntValue(n + i)
+	}
+	if val.Tail != nil || val.Head < 0 || val.Head >= len(e.identity) {
+		return nil
+	}
 	name := e.identity[val.Head]
-	typ := e.types[name]
+	typ, ok := e.types[name]
+	if !ok {
+		return nil
+	}
 	pos := e.position[name] + i
-	for {
-		if pos >= 0 {
-			break
+	if typ.Sort != CENUM {
+		if pos < 0 || pos >= len(typ.Elem) {
+			return nil
 		}
+		return e.order[typ.Elem[pos]]
+	}
+	pos = pos % len(typ.Elem)
+	if pos < 0 {
 		pos = pos + len(typ.Elem)
 	}
-	return e.order[typ.Elem[pos%len(typ.Elem)]]
+	return e.order[typ.Elem[pos]]
 }
 
 // ----------------------------------------------------------------------
@@ -55,18 +72,27 @@ func (d *Decoder) Build(net *Net) error {
 	}
 
 	net.Name = pnml.Net.Name
-	net.Page = pnml.Net.Page
+	net.Type = pnml.Net.Type
+	net.Pages = pnml.Net.Pages
 	net.Declaration = pnml.Net.Declaration
+	if err := net.flatten(); err != nil {
+		return err
+	}
 
 	// we allocate the enumerators and other useful maps
 	net.TypeEnvt = make(map[string]string)
 	net.types = make(map[string]*TypeDecl)
+	net.sorts = make(map[string]*TypeDecl)
 	net.ranges = make(map[IntRange]*TypeDecl)
 	net.position = make(map[string]int)
 	net.order = make(map[string]*Value)
 	net.identity = make([]string, 1)
 	net.Unique = make(map[Value]*Value)
 	net.World = make(map[string][]*Value)
+	net.numbers = &numbers{
+		values: make(map[int]*Value),
+		extra:  make(map[Value]*Value),
+	}
 
 	// we allocate the constant for dot
 	net.vdot = &Value{Head: 0}
@@ -74,8 +100,24 @@ func (d *Decoder) Build(net *Net) error {
 	net.Unique[Value{Head: 0}] = net.vdot
 	ccount := 1
 
+	// we allocate the constants of the bool sort, that can be used without
+	// being declared
+	net.vfalse = &Value{Head: 1}
+	net.vtrue = &Value{Head: 2}
+	net.identity = append(net.identity, "false", "true")
+	net.Unique[*net.vfalse] = net.vfalse
+	net.Unique[*net.vtrue] = net.vtrue
+	net.World["bool"] = []*Value{net.vfalse, net.vtrue}
+	ccount = 3
+
+	// P/T nets have no declarations, we only need the dot sort
+	if net.Type == PTNet {
+		net.Declaration = Declaration{Sorts: []*TypeDecl{{ID: "dot", Dot: &struct{}{}}}}
+	}
+
 	// we make a pass through the constant definitions
 	for _, v := range net.Declaration.Sorts {
+		net.sorts[v.ID] = v
 		switch {
 		case v.Dot != nil:
 			v.Sort = DOT
@@ -120,12 +162,22 @@ func (d *Decoder) Build(net *Net) error {
 				v.Elem[i] = c.ID
 				net.position[c.ID] = i
 			}
+		case v.Bool != nil:
+			v.Sort = BOOL
+			net.World[v.ID] = net.World["bool"]
+		case v.NumSort.Name() != "":
+			// integer sorts are infinite and have no entry in World
+			v.Sort = NUMERIC
 		case v.Product != nil:
 			v.Sort = PROD
 			v.Elem = make([]string, len(v.Product))
 			for i, c := range v.Product {
 				v.Elem[i] = c.ID
 			}
+		case v.Alias != nil:
+			// a namedsort that is just another name for a user sort
+			v.Sort = ALIAS
+			v.Elem = []string{v.Alias.ID}
 		}
 		if v.Sort == CENUM || v.Sort == FENUM {
 			list := make([]*Value, len(v.Elem))
@@ -142,31 +194,74 @@ func (d *Decoder) Build(net *Net) error {
 		}
 	}
 
+	// we compute the values of product sorts and aliases last, since they
+	// can refer to sorts declared after them
 	for _, v := range net.Declaration.Sorts {
-		if v.Sort == PROD {
-			net.World[v.ID] = net.enumprod(v.Elem)
+		if _, err := net.enumsort(v.ID, map[string]bool{}); err != nil {
+			return fmt.Errorf("error in declaration of sort %s: %s", v.ID, err)
+		}
+	}
+
+	// nested is true when a product sort has a component that is also a
+	// product, in which case we need the width of tuple components during
+	// unification
+	for _, v := range net.Declaration.Sorts {
+		if v.Sort == PROD && net.width(v.ID) != len(v.Elem) {
+			net.nested = true
 		}
 	}
 
 	for _, v := range net.Declaration.Vars {
+		if name := v.NumSort.Name(); name != "" {
+			net.TypeEnvt[v.ID] = name
+			continue
+		}
+		if v.Bool != nil {
+			net.TypeEnvt[v.ID] = "bool"
+			continue
+		}
 		net.TypeEnvt[v.ID] = v.Type.ID
 	}
 
-	// we associate the list of partition element to their identifiers
+	// we associate the list of partition element to their identifiers. Each
+	// partition element is also a constant of the sort defined by its
+	// partition, with values allocated in the order of declaration, so that
+	// they can be compared with gtp and ltp.
+	net.parts = make(map[string]*Value)
+	net.partitions = make(map[string]map[*Value]*Value)
 	for _, p := range net.Declaration.Partitions {
-		for _, pe := range p.Partitions {
+		list := make([]*Value, len(p.Partitions))
+		elemof := make(map[*Value]*Value)
+		for i, pe := range p.Partitions {
+			pval := Value{Head: ccount}
+			ccount++
+			net.identity = append(net.identity, pe.ID)
+			net.Unique[pval] = &pval
+			net.parts[pe.ID] = &pval
+			net.position[pe.ID] = i
+			list[i] = &pval
 			val := []*Value{}
 			for _, e := range pe.Elem {
 				val = append(val, net.order[e.ID])
+				elemof[net.order[e.ID]] = &pval
 			}
 			net.World[pe.ID] = val
 		}
+		net.World[p.ID] = list
+		net.partitions[p.ID] = elemof
+	}
+
+	if net.Type == PTNet {
+		if err := net.buildPT(); err != nil {
+			return err
+		}
+		return net.check()
 	}
 
-	// We parse the expressions in the places, transitions and arcs of the first
-	// page.
+	// We parse the expressions in the places, transitions and arcs of the
+	// (flattened) page.
 	for _, t := range net.Page.Trans {
-		exp, err := parseExpression(t.XML.InnerXML)
+		exp, err := parseExpression(t.XML, "transition "+t.ID)
 		if err != nil {
 			return err
 		}
@@ -175,13 +270,15 @@ func (d *Decoder) Build(net *Net) error {
 		}
 		e, ok := exp.(Operation)
 		if !ok {
-			return fmt.Errorf("invalid condition in a PNML transition")
+			// the condition can be any boolean expression, like a variable
+			// or a boolean constant
+			e = Operation{Op: EQ, Elem: []Expression{exp, BoolConstant(true)}}
 		}
 		t.Condition = e
 	}
 
 	for _, p := range net.Page.Places {
-		exp, err := parseExpression(p.XML.InnerXML)
+		exp, err := parseExpression(p.XML, "place "+p.ID)
 		if err != nil {
 			return err
 		}
@@ -189,12 +286,148 @@ func (d *Decoder) Build(net *Net) error {
 	}
 
 	for _, a := range net.Page.Arcs {
-		exp, err := parseExpression(a.XML.InnerXML)
+		exp, err := parseExpression(a.XML, a.describe())
 		if err != nil {
 			return err
 		}
 		a.Pattern = exp
 	}
 
+	return net.check()
+}
+
+// ----------------------------------------------------------------------
+
+// buildPT computes the expressions in the places, transitions and arcs of a
+// P/T net. The marking of a place with n tokens is the multiset n'dot, and
+// every place has the dot sort. Arcs without inscription have weight 1.
+func (net *Net) buildPT() error {
+	ptvalue := func(s string, def int) (int, error) {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			return def, nil
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("bad integer value %q", s)
+		}
+		return n, nil
+	}
+
+	for _, t := range net.Page.Trans {
+		t.Condition = Operation{Op: NIL}
+	}
+
+	for _, p := range net.Page.Places {
+		n, err := ptvalue(p.PTMarking, 0)
+		if err != nil {
+			return fmt.Errorf("error in initial marking of place %s: %s", p.ID, err)
+		}
+		p.Type = Type{ID: "dot"}
+		if n != 0 {
+			p.InitialMarking = Numberof{Expression: Dot{}, Mult: n}
+		}
+	}
+
+	for _, a := range net.Page.Arcs {
+		n, err := ptvalue(a.PTValue, 1)
+		if err != nil {
+			return fmt.Errorf("error in inscription of %s: %s", a.describe(), err)
+		}
+		a.Pattern = Numberof{Expression: Dot{}, Mult: n}
+	}
+
+	return nil
+}
+
+// ----------------------------------------------------------------------
+
+// flatten collects the places, transitions and arcs of all the pages in the
+// net, in document order, into net.Page. Arcs between reference nodes are
+// redirected to the place or transition they stand for, so that the result
+// only uses the IDs of actual nodes.
+func (net *Net) flatten() error {
+	net.Page = Page{}
+	kind := make(map[string]string)
+	refs := make(map[string]*RefNode)
+
+	var collect func(pages []*Page) error
+	collect = func(pages []*Page) error {
+		for _, page := range pages {
+			for _, p := range page.Places {
+				if _, ok := kind[p.ID]; ok {
+					return fmt.Errorf("duplicate id %s in PNML net", p.ID)
+				}
+				kind[p.ID] = "place"
+				net.Page.Places = append(net.Page.Places, p)
+			}
+			for _, t := range page.Trans {
+				if _, ok := kind[t.ID]; ok {
+					return fmt.Errorf("duplicate id %s in PNML net", t.ID)
+				}
+				kind[t.ID] = "transition"
+				net.Page.Trans = append(net.Page.Trans, t)
+			}
+			for _, r := range page.RefPlaces {
+				if _, ok := kind[r.ID]; ok {
+					return fmt.Errorf("duplicate id %s in PNML net", r.ID)
+				}
+				kind[r.ID] = "referencePlace"
+				refs[r.ID] = r
+			}
+			for _, r := range page.RefTrans {
+				if _, ok := kind[r.ID]; ok {
+					return fmt.Errorf("duplicate id %s in PNML net", r.ID)
+				}
+				kind[r.ID] = "referenceTransition"
+				refs[r.ID] = r
+			}
+			net.Page.Arcs = append(net.Page.Arcs, page.Arcs...)
+			if err := collect(page.Pages); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := collect(net.Pages); err != nil {
+		return err
+	}
+
+	// resolve follows a chain of references until we find a place or a
+	// transition. We check that references to places (resp. transitions)
+	// end up on a place (resp. transition).
+	resolve := func(id string) (string, error) {
+		visited := make(map[string]bool)
+		for {
+			r, ok := refs[id]
+			if !ok {
+				return id, nil
+			}
+			if visited[id] {
+				return "", fmt.Errorf("cyclic reference %s in PNML net", id)
+			}
+			visited[id] = true
+			target, ok := kind[r.Ref]
+			switch {
+			case !ok:
+				return "", fmt.Errorf("reference %s to unknown node %s", r.ID, r.Ref)
+			case kind[id] == "referencePlace" && (target == "transition" || target == "referenceTransition"),
+				kind[id] == "referenceTransition" && (target == "place" || target == "referencePlace"):
+				return "", fmt.Errorf("reference %s to node %s of the wrong kind (%s)", r.ID, r.Ref, target)
+			}
+			id = r.Ref
+		}
+	}
+
+	for _, a := range net.Page.Arcs {
+		var err error
+		if a.Source, err = resolve(a.Source); err != nil {
+			return err
+		}
+		if a.Target, err = resolve(a.Target); err != nil {
+			return err
+		}
+	}
 	return nil
 }
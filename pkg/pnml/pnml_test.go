@@ -2,11 +2,16 @@ package pnml
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -74,6 +79,94 @@ func TestBuild(t *testing.T) {
 	}
 }
 
+// pagesPNML is a net with two top-level pages, a nested page, and reference
+// nodes used as the source and target of arcs.
+const pagesPNML = `<?xml version="1.0"?>
+<pnml xmlns="http://www.pnml.org/version-2009/grammar/pnml">
+  <net id="pages" type="http://www.pnml.org/version-2009/grammar/symmetricnet">
+    <name><text>pages</text></name>
+    <declaration><structure><declarations>
+      <namedsort id="dot" name="dot"><dot/></namedsort>
+    </declarations></structure></declaration>
+    <page id="p1">
+      <place id="A"><type><structure><usersort declaration="dot"/></structure></type></place>
+      <transition id="t1"/>
+      <arc id="a1" source="A" target="t1"/>
+      <page id="p11">
+        <place id="B"><type><structure><usersort declaration="dot"/></structure></type></place>
+        <referenceTransition id="rt1" ref="t1"/>
+        <arc id="a2" source="rt1" target="B"/>
+      </page>
+    </page>
+    <page id="p2">
+      <referencePlace id="rB" ref="B"/>
+      <referencePlace id="rrB" ref="rB"/>
+      <transition id="t2"/>
+      <arc id="a3" source="rrB" target="t2"/>
+    </page>
+  </net>
+</pnml>`
+
+func TestBuildPages(t *testing.T) {
+	var p = new(Net)
+	if err := NewDecoder(strings.NewReader(pagesPNML)).Build(p); err != nil {
+		t.Fatalf("pnml.Build(): error decoding PNML net with pages: %s", err)
+	}
+	if len(p.Page.Places) != 2 || len(p.Page.Trans) != 2 || len(p.Page.Arcs) != 3 {
+		t.Errorf("pnml.Build(): wrong number of nodes in flattened page (%d places, %d transitions, %d arcs)",
+			len(p.Page.Places), len(p.Page.Trans), len(p.Page.Arcs))
+	}
+	expected := []string{"A -> t1", "t1 -> B", "B -> t2"}
+	for i, a := range p.Page.Arcs {
+		if s := a.Source + " -> " + a.Target; s != expected[i] {
+			t.Errorf("pnml.Build(): arc %s instead of %s", s, expected[i])
+		}
+	}
+
+	bad := strings.Replace(pagesPNML, `ref="rB"`, `ref="t2"`, 1)
+	if err := NewDecoder(strings.NewReader(bad)).Build(new(Net)); err == nil {
+		t.Errorf("pnml.Build(): expected an error with a referencePlace pointing to a transition")
+	}
+}
+
+// ptPNML is a P/T net with a weighted arc and an arc without inscription.
+const ptPNML = `<?xml version="1.0"?>
+<pnml xmlns="http://www.pnml.org/version-2009/grammar/pnml">
+  <net id="pt" type="http://www.pnml.org/version-2009/grammar/ptnet">
+    <name><text>pt</text></name>
+    <page id="page">
+      <place id="A"><initialMarking><text>3</text></initialMarking></place>
+      <place id="B"/>
+      <transition id="t"/>
+      <arc id="a1" source="A" target="t"><inscription><text>2</text></inscription></arc>
+      <arc id="a2" source="t" target="B"/>
+    </page>
+  </net>
+</pnml>`
+
+func TestBuildPT(t *testing.T) {
+	var p = new(Net)
+	if err := NewDecoder(strings.NewReader(ptPNML)).Build(p); err != nil {
+		t.Fatalf("pnml.Build(): error decoding P/T net: %s", err)
+	}
+	m, err := p.Page.Places[0].InitialMarking.Eval(p, nil)
+	if err != nil {
+		t.Fatalf("pnml.Eval(): %s", err)
+	}
+	if len(m) != 1 || m[0].Mult != 3 || m[0].Value != p.vdot {
+		t.Errorf("pnml.Build(): initial marking of place A should be 3'dot, not %v", m)
+	}
+	if p.Page.Places[1].InitialMarking != nil {
+		t.Errorf("pnml.Build(): place B should be empty")
+	}
+	for i, w := range []int{2, 1} {
+		m, _ := p.Page.Arcs[i].Pattern.Eval(p, nil)
+		if len(m) != 1 || m[0].Mult != w {
+			t.Errorf("pnml.Build(): arc %d should have weight %d, not %v", i+1, w, m)
+		}
+	}
+}
+
 var result string
 
 func BenchmarkBuild(b *testing.B) {
@@ -106,3 +199,291 @@ func BenchmarkBuild(b *testing.B) {
 		}
 	}
 }
+
+// orderPNML declares an enumeration, D, before a range, R, and a transition
+// whose condition compares a variable of sort R with a constant of the same
+// sort.
+const orderPNML = `<?xml version="1.0"?>
+<pnml xmlns="http://www.pnml.org/version-2009/grammar/pnml">
+  <net id="order" type="http://www.pnml.org/version-2009/grammar/symmetricnet">
+    <name><text>order</text></name>
+    <declaration><structure><declarations>
+      <namedsort id="D" name="D"><finiteenumeration><feconstant id="d1" name="d1"/><feconstant id="d2" name="d2"/></finiteenumeration></namedsort>
+      <namedsort id="R" name="R"><finiteintrange start="1" end="3"/></namedsort>
+      <variabledecl id="x" name="x"><usersort declaration="R"/></variabledecl>
+    </declarations></structure></declaration>
+    <page id="page">
+      <transition id="t">
+        <condition><structure><lessthan>
+          <subterm><variable refvariable="x"/></subterm>
+          <subterm><finiteintrangeconstant value="2"><finiteintrange start="1" end="3"/></finiteintrangeconstant></subterm>
+        </lessthan></structure></condition>
+      </transition>
+    </page>
+  </net>
+</pnml>`
+
+func TestOrder(t *testing.T) {
+	var p = new(Net)
+	if err := NewDecoder(strings.NewReader(orderPNML)).Build(p); err != nil {
+		t.Fatalf("pnml.Build(): error decoding net: %s", err)
+	}
+	r := func(n int) Expression { return FIRConstant{value: n, start: 1, end: 3} }
+	tests := []struct {
+		e1, e2 Expression
+		less   bool
+	}{
+		{r(1), r(3), true},
+		{r(3), r(1), false},
+		{Tuple{r(2), Constant("d1")}, Tuple{r(2), Constant("d2")}, true},
+		{Tuple{r(2), Constant("d2")}, Tuple{r(3), Constant("d1")}, true},
+		{Tuple{r(3), Constant("d1")}, Tuple{r(2), Constant("d2")}, false},
+		{Tuple{r(2), Constant("d2")}, Tuple{r(2), Constant("d2")}, false},
+	}
+	for _, tt := range tests {
+		op := Operation{Op: LESSTHAN, Elem: []Expression{tt.e1, tt.e2}}
+		if ok, err := op.OK(p, nil); err != nil || ok != tt.less {
+			t.Errorf("%s should be %v", op, tt.less)
+		}
+	}
+
+	bad := strings.Replace(orderPNML, `<finiteintrangeconstant value="2"><finiteintrange start="1" end="3"/></finiteintrangeconstant>`, `<useroperator declaration="d1"/>`, 1)
+	if err := NewDecoder(strings.NewReader(bad)).Build(new(Net)); err == nil {
+		t.Errorf("pnml.Build(): comparing values of sort R and D should be a type error")
+	}
+}
+
+func TestUndefinedConditions(t *testing.T) {
+	var p = new(Net)
+	if err := NewDecoder(strings.NewReader(orderPNML)).Build(p); err != nil {
+		t.Fatalf("pnml.Build(): error decoding net: %s", err)
+	}
+	// the successor of d2 is undefined, since D is not a cyclic enumeration.
+	// An undefined comparison is false, and so is its negation.
+	next := func(c string) Expression { return Successor{Expression: Constant(c), Incr: 1} }
+	op := func(o OP, e ...Expression) Operation { return Operation{Op: o, Elem: e} }
+	eq := op(EQ, next("d2"), Constant("d1"))
+	tests := []struct {
+		e  Operation
+		ok bool
+	}{
+		{op(EQ, next("d1"), Constant("d2")), true},
+		{op(NOT, op(EQ, next("d1"), Constant("d1"))), true},
+		{eq, false},
+		{op(INEQ, next("d2"), Constant("d1")), false},
+		{op(NOT, eq), false},
+		{op(IMPLY, eq, op(EQ, Constant("d1"), Constant("d2"))), false},
+		{op(AND, op(EQ, Constant("d1"), Constant("d1")), op(NOT, eq)), false},
+		{op(OR, op(NOT, eq), op(EQ, Constant("d1"), Constant("d2"))), false},
+		{op(OR, op(EQ, Constant("d1"), Constant("d1")), op(NOT, eq)), true},
+	}
+	for _, tt := range tests {
+		if ok, err := tt.e.OK(p, nil); err != nil || ok != tt.ok {
+			t.Errorf("%s should be %v (%v)", tt.e, tt.ok, err)
+		}
+	}
+	if _, err := op(NOT, eq).Eval(p, nil); !errors.Is(err, ErrUndefined) {
+		t.Errorf("%s should be undefined, got %v", op(NOT, eq), err)
+	}
+}
+
+// sameNet returns an error if the two nets have different declarations, or if
+// their places, transitions and arcs are not described by the same
+// expressions.
+func sameNet(p1, p2 *Net) error {
+	if s1, s2 := p1.String(), p2.String(); s1 != s2 {
+		return fmt.Errorf("declarations differ:\n%s\n%s", s1, s2)
+	}
+	str := func(e Expression) string {
+		if e == nil {
+			return "<nil>"
+		}
+		return e.String()
+	}
+	if len(p1.Page.Places) != len(p2.Page.Places) || len(p1.Page.Trans) != len(p2.Page.Trans) || len(p1.Page.Arcs) != len(p2.Page.Arcs) {
+		return fmt.Errorf("pages have different sizes")
+	}
+	for i, p := range p1.Page.Places {
+		q := p2.Page.Places[i]
+		if p.ID != q.ID || p.Type != q.Type || str(p.InitialMarking) != str(q.InitialMarking) {
+			return fmt.Errorf("place %s differs: %s and %s", p.ID, str(p.InitialMarking), str(q.InitialMarking))
+		}
+	}
+	for i, t := range p1.Page.Trans {
+		u := p2.Page.Trans[i]
+		if t.ID != u.ID || t.Condition.String() != u.Condition.String() {
+			return fmt.Errorf("transition %s differs: %s and %s", t.ID, t.Condition, u.Condition)
+		}
+	}
+	for i, a := range p1.Page.Arcs {
+		b := p2.Page.Arcs[i]
+		if a.Source != b.Source || a.Target != b.Target || str(a.Pattern) != str(b.Pattern) {
+			return fmt.Errorf("arc from %s to %s differs: %s and %s", a.Source, a.Target, str(a.Pattern), str(b.Pattern))
+		}
+	}
+	return nil
+}
+
+func TestEncode(t *testing.T) {
+	inputs := map[string]func() (io.ReadCloser, error){
+		"pages": func() (io.ReadCloser, error) { return io.NopCloser(strings.NewReader(pagesPNML)), nil },
+		"pt":    func() (io.ReadCloser, error) { return io.NopCloser(strings.NewReader(ptPNML)), nil },
+		"order": func() (io.ReadCloser, error) { return io.NopCloser(strings.NewReader(orderPNML)), nil },
+	}
+	models, _ := filepath.Glob(filepath.Join("..", "..", "benchmarks", "*", "model.pnml"))
+	for _, m := range models {
+		m := m
+		inputs[m] = func() (io.ReadCloser, error) { return os.Open(m) }
+	}
+	for name, open := range inputs {
+		r, err := open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		p1 := new(Net)
+		err = NewDecoder(r).Build(p1)
+		r.Close()
+		if err != nil {
+			t.Errorf("pnml.Build(): error decoding %s: %s", name, err)
+			continue
+		}
+		var b bytes.Buffer
+		if err := NewEncoder(&b).Encode(p1); err != nil {
+			t.Errorf("Encode(): error encoding %s: %s", name, err)
+			continue
+		}
+		p2 := new(Net)
+		if err := NewDecoder(&b).Build(p2); err != nil {
+			t.Errorf("pnml.Build(): error decoding the encoding of %s: %s", name, err)
+			continue
+		}
+		if err := sameNet(p1, p2); err != nil {
+			t.Errorf("Encode(): round trip on %s: %s", name, err)
+		}
+	}
+}
+
+// badPNML is a net with one type error in each of its nodes.
+const badPNML = `<?xml version="1.0"?>
+<pnml xmlns="http://www.pnml.org/version-2009/grammar/pnml">
+  <net id="bad" type="http://www.pnml.org/version-2009/grammar/symmetricnet">
+    <name><text>bad</text></name>
+    <declaration><structure><declarations>
+      <namedsort id="C" name="C"><finiteenumeration><feconstant id="c" name="c"/></finiteenumeration></namedsort>
+      <namedsort id="D" name="D"><finiteenumeration><feconstant id="d" name="d"/></finiteenumeration></namedsort>
+      <variabledecl id="x" name="x"><usersort declaration="C"/></variabledecl>
+    </declarations></structure></declaration>
+    <page id="page">
+      <place id="P">
+        <type><structure><usersort declaration="C"/></structure></type>
+        <hlinitialMarking><structure><useroperator declaration="d"/></structure></hlinitialMarking>
+      </place>
+      <transition id="t">
+        <condition><structure><equality>
+          <subterm><variable refvariable="x"/></subterm>
+          <subterm><useroperator declaration="d"/></subterm>
+        </equality></structure></condition>
+      </transition>
+      <arc id="a1" source="P" target="t">
+        <hlinscription><structure><variable refvariable="y"/></structure></hlinscription>
+      </arc>
+      <arc id="a2" source="t" target="P">
+        <hlinscription><structure><useroperator declaration="e"/></structure></hlinscription>
+      </arc>
+    </page>
+  </net>
+</pnml>`
+
+func TestCheck(t *testing.T) {
+	err := NewDecoder(strings.NewReader(badPNML)).Build(new(Net))
+	errs, ok := err.(TypeErrors)
+	if !ok {
+		t.Fatalf("pnml.Build(): expected type errors, not %v", err)
+	}
+	expected := []string{"place P", "transition t", "arc a1 from P to t", "arc a2 from t to P"}
+	if len(errs) != len(expected) {
+		t.Fatalf("pnml.Build(): expected %d type errors, not %s", len(expected), errs)
+	}
+	for i, id := range expected {
+		if errs[i].ID != id {
+			t.Errorf("pnml.Build(): error %d should be in %s, not %s", i, id, errs[i])
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	var p = new(Net)
+	if err := NewDecoder(strings.NewReader(orderPNML)).Build(p); err != nil {
+		t.Fatalf("pnml.Build(): error decoding net: %s", err)
+	}
+	if _, err := Constant("foo").Eval(p, nil); !errors.Is(err, ErrEvaluation) {
+		t.Errorf("pnml.Eval(): unknown constant should be an evaluation error, not %v", err)
+	}
+	venv := VEnv{"x": nil}
+	pattern := Arithmetic{Op: MULT, Elem: []Expression{Var("x"), IntConstant(2)}}
+	_, err := pattern.Unify(p, p.IntValue(4), venv)
+	var uerr *UnsupportedError
+	if !errors.Is(err, ErrUnsupportedFeature) || !errors.As(err, &uerr) {
+		t.Fatalf("pnml.Unify(): %s should be unsupported, not %v", pattern, err)
+	}
+	if !strings.Contains(uerr.Construct, pattern.String()) {
+		t.Errorf("pnml.Unify(): error should report %s, not %s", pattern, uerr.Construct)
+	}
+}
+
+func TestSyntaxError(t *testing.T) {
+	bad := strings.Replace(orderPNML, `<variable refvariable="x"/>`, `<foo/>`, 1)
+	i := strings.Index(bad, "<foo/>")
+	line := strings.Count(bad[:i], "\n") + 1
+	col := i - strings.LastIndex(bad[:i], "\n")
+	err := NewDecoder(strings.NewReader(bad)).Build(new(Net))
+	var serr *SyntaxError
+	if !errors.As(err, &serr) {
+		t.Fatalf("pnml.Build(): expected a syntax error, not %v", err)
+	}
+	if serr.Line != line || serr.Col != col || serr.ID != "transition t" {
+		t.Errorf("pnml.Build(): error should be at line %d, column %d in transition t, not %s", line, col, serr)
+	}
+}
+
+func TestMultiset(t *testing.T) {
+	var p = new(Net)
+	if err := NewDecoder(strings.NewReader(orderPNML)).Build(p); err != nil {
+		t.Fatalf("pnml.Build(): error decoding net: %s", err)
+	}
+	a, b, c := p.IntValue(1), p.IntValue(2), p.IntValue(3)
+	m1 := NewMultiset([]Atom{{c, 1}, {a, 2}, {b, 0}, {c, 1}})
+	m2 := NewMultiset([]Atom{{b, 1}, {a, 1}, {c, -1}})
+	if len(m1) != 2 || m1.Mult(a) != 2 || m1.Mult(c) != 2 {
+		t.Errorf("pnml.NewMultiset(): expected 2'1 2'3, not %s", p.PrintHue(m1))
+	}
+	if u := m1.Union(m2); !u.Equal(NewMultiset([]Atom{{a, 3}, {b, 1}, {c, 2}})) {
+		t.Errorf("pnml.Union(): expected 3'1 1'2 2'3, not %s", p.PrintHue(u))
+	}
+	if d := m1.Diff(m2.Scale(2)); !d.Equal(NewMultiset([]Atom{{c, 2}})) {
+		t.Errorf("pnml.Diff(): expected 2'3, not %s", p.PrintHue(d))
+	}
+	if !m1.Union(m2).Includes(m1) || m1.Includes(m2) {
+		t.Errorf("pnml.Includes(): wrong inclusion between %s and %s", p.PrintHue(m1), p.PrintHue(m2))
+	}
+	if m1.Card() != 4 || m1.Mult(c) != 2 || m1.Mult(b) != 0 {
+		t.Errorf("pnml.Card(): wrong cardinality for %s", p.PrintHue(m1))
+	}
+	m3 := m2.Union(m1)
+	if !m3.Equal(m1.Union(m2)) || m3.Hash() != m1.Union(m2).Hash() {
+		t.Errorf("pnml.Union(): union should be commutative")
+	}
+	if ValueIsLess(nil, nil) || ValueIsLess(a, a) || !ValueIsLess(p.IntValue(-1), a) {
+		t.Errorf("pnml.ValueIsLess(): wrong order on integers")
+	}
+
+	// the hash does not depend on the order in which integers are interned
+	var q = new(Net)
+	if err := NewDecoder(strings.NewReader(orderPNML)).Build(q); err != nil {
+		t.Fatalf("pnml.Build(): error decoding net: %s", err)
+	}
+	m4 := NewMultiset([]Atom{{q.IntValue(3), 2}, {q.IntValue(1), 3}, {q.IntValue(2), 1}})
+	if m4.Hash() != m3.Hash() || p.PrintHue(m3) != q.PrintHue(m4) {
+		t.Errorf("pnml.Hash(): %s and %s should have the same hash", p.PrintHue(m3), q.PrintHue(m4))
+	}
+}
@@ -36,6 +36,12 @@ func (typ TypeDecl) String() string {
 		default:
 			s += typ.Elem[0] + " ... " + typ.Elem[len(typ.Elem)-1]
 		}
+	case typ.Sort == BOOL:
+		s += "bool"
+	case typ.Sort == NUMERIC:
+		s += typ.NumSort.Name()
+	case typ.Sort == ALIAS:
+		s += typ.Alias.ID
 	case typ.Sort == PROD:
 		s += "("
 		if typ.Product == nil {
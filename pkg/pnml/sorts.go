@@ -0,0 +1,218 @@
+// Copyright 2023. Silvano DAL ZILIO (LAAS-CNRS). All rights reserved. Use of
+// this source code is governed by the GNU Affero license that can be found in
+// the LICENSE file.
+
+package pnml
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ----------------------------------------------------------------------
+
+// rank returns the position of a (non tuple) value in its sort. This is the
+// position of the constant in its declaration for enumerations, ranges and
+// partition elements, and the value itself for integers. The dot and the
+// booleans (with false < true) are ordered using their Head.
+//
+// rank is called on every comparison in a guard, so it should not allocate. We
+// decode integers directly from the Head of v (see intHead), since v may be a
+// component of a tuple, for which IntOf returns false.
+func (net *Net) rank(v *Value) int {
+	if v.Head < 0 {
+		return headInt(v.Head)
+	}
+	if v.Head >= len(net.identity) {
+		return v.Head
+	}
+	if pos, ok := net.position[net.identity[v.Head]]; ok {
+		return pos
+	}
+	return v.Head
+}
+
+// compareValues returns -1, 0 or +1 depending on whether v1 is less, equal or
+// greater than v2. Tuples are compared using the lexicographic order on their
+// components. We assume that v1 and v2 are values of the same sort.
+func (net *Net) compareValues(v1, v2 *Value) int {
+	for v1 != nil && v2 != nil {
+		if v1 == v2 {
+			return 0
+		}
+		r1, r2 := net.rank(v1), net.rank(v2)
+		if r1 < r2 {
+			return -1
+		}
+		if r1 > r2 {
+			return 1
+		}
+		v1, v2 = v1.Tail, v2.Tail
+	}
+	switch {
+	case v1 == nil && v2 == nil:
+		return 0
+	case v1 == nil:
+		return -1
+	}
+	return 1
+}
+
+// ----------------------------------------------------------------------
+
+// canonicalSort returns a name for the sort with identifier id, such that two
+// sorts have the same name if and only if they have the same values. This is
+// the case for finite int ranges with the same bounds, for the different
+// integer sorts, and for product sorts with the same components. It returns
+// the empty string if id is not a known sort.
+func (net *Net) canonicalSort(id string) string {
+	switch id {
+	case "integer", "natural", "positive":
+		return "integer"
+	case "bool", "dot":
+		return id
+	}
+	for _, p := range net.Declaration.Partitions {
+		if p.ID == id {
+			return id
+		}
+	}
+	typ, ok := net.sorts[id]
+	if !ok {
+		return ""
+	}
+	switch typ.Sort {
+	case ALIAS:
+		return net.canonicalSort(typ.Elem[0])
+	case DOT:
+		return "dot"
+	case BOOL:
+		return "bool"
+	case NUMERIC:
+		return "integer"
+	case FINTRANGE:
+		return net.ranges[*typ.FIntRan].ID
+	case PROD:
+		comps := make([]string, len(typ.Elem))
+		for i, c := range typ.Elem {
+			comps[i] = net.canonicalSort(c)
+		}
+		return prodSort(comps)
+	}
+	return typ.ID
+}
+
+// prodSort returns the canonical name of the product of sorts with canonical
+// names comps. Nested products are flattened, like tuple values, and the
+// product of a single sort is the sort itself. The result is the empty string
+// if one of the components is unknown.
+func prodSort(comps []string) string {
+	for i, c := range comps {
+		if c == "" {
+			return ""
+		}
+		comps[i] = strings.TrimSuffix(strings.TrimPrefix(c, "("), ")")
+	}
+	if len(comps) == 1 && !strings.Contains(comps[0], ",") {
+		return comps[0]
+	}
+	return "(" + strings.Join(comps, ", ") + ")"
+}
+
+// ----------------------------------------------------------------------
+
+// enumsort computes the list of values of the sort with identifier id, and
+// stores it in World, when id is a product sort or an alias. We follow the
+// references between sorts recursively and use visiting to detect cycles. The
+// result is nil for sorts that have no entry in World, like integers.
+func (net *Net) enumsort(id string, visiting map[string]bool) ([]*Value, error) {
+	if w, ok := net.World[id]; ok {
+		return w, nil
+	}
+	typ, ok := net.sorts[id]
+	if !ok {
+		if net.canonicalSort(id) == "integer" {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unknown sort %s", id)
+	}
+	if typ.Sort != ALIAS && typ.Sort != PROD {
+		return nil, nil
+	}
+	if visiting[id] {
+		return nil, fmt.Errorf("sort %s is defined using itself", id)
+	}
+	visiting[id] = true
+	defer delete(visiting, id)
+
+	lists := make([][]*Value, len(typ.Elem))
+	for i, c := range typ.Elem {
+		w, err := net.enumsort(c, visiting)
+		if err != nil {
+			return nil, err
+		}
+		if w == nil {
+			// we cannot enumerate the values of c
+			return nil, nil
+		}
+		lists[i] = w
+	}
+	if typ.Sort == ALIAS {
+		net.World[id] = lists[0]
+	} else {
+		net.World[id] = net.enumprod(lists)
+	}
+	return net.World[id], nil
+}
+
+// width returns the number of (atomic) components in the values of the sort
+// with identifier id. This is 1 except for product sorts.
+func (net *Net) width(id string) int {
+	typ, ok := net.sorts[id]
+	if !ok {
+		return 1
+	}
+	switch typ.Sort {
+	case ALIAS:
+		return net.width(typ.Elem[0])
+	case PROD:
+		n := 0
+		for _, c := range typ.Elem {
+			n += net.width(c)
+		}
+		return n
+	}
+	return 1
+}
+
+// widthOf returns the number of (atomic) components in the values of
+// expression e, see width.
+func (net *Net) widthOf(e Expression) int {
+	switch e := e.(type) {
+	case Var:
+		return net.width(net.TypeEnvt[string(e)])
+	case All:
+		return net.width(string(e))
+	case Tuple:
+		n := 0
+		for _, c := range e {
+			n += net.widthOf(c)
+		}
+		return n
+	case Add:
+		if len(e) != 0 {
+			return net.widthOf(e[0])
+		}
+	case Subtract:
+		if len(e) != 0 {
+			return net.widthOf(e[0])
+		}
+	case Numberof:
+		if e.Expression != nil {
+			return net.widthOf(e.Expression)
+		}
+	case ScalarProduct:
+		return net.widthOf(e.Expression)
+	}
+	return 1
+}
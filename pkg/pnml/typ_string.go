@@ -12,11 +12,13 @@ func _() {
 	_ = x[FINTRANGE-3]
 	_ = x[PROD-4]
 	_ = x[NUMERIC-5]
+	_ = x[BOOL-6]
+	_ = x[ALIAS-7]
 }
 
-const _TYP_name = "DOTCENUMFENUMFINTRANGEPRODNUMERIC"
+const _TYP_name = "DOTCENUMFENUMFINTRANGEPRODNUMERICBOOLALIAS"
 
-var _TYP_index = [...]uint8{0, 3, 8, 13, 22, 26, 33}
+var _TYP_index = [...]uint8{0, 3, 8, 13, 22, 26, 33, 37, 42}
 
 func (i TYP) String() string {
 	if i < 0 || i >= TYP(len(_TYP_index)-1) {
@@ -4,18 +4,25 @@
 
 package pnml
 
+import "github.com/dalzilio/hue/pkg/internal/rawxml"
+
 // ----------------------------------------------------------------------
 
 // pnml is the type of PNML net. We ignore the graphical information contained
-// in the net and only consider the first page
+// in the net.
 type pnml struct {
 	Net Net `xml:"net"`
 }
 
-// Net is the type of the net element in a PNML file.
+// Net is the type of the net element in a PNML file. The places, transitions
+// and arcs of all the pages in the file, including nested pages, are collected
+// into a single page, Page, where reference nodes have been replaced by their
+// targets.
 type Net struct {
 	Name        string      `xml:"name>text"`
-	Page        Page        `xml:"page"`
+	Type        string      `xml:"type,attr"`
+	Pages       []*Page     `xml:"page"`
+	Page        Page        `xml:"-"`
 	Declaration Declaration `xml:"declaration>structure>declarations"`
 	// TypeEnvt is an association between a variable name and its type name, found in declaration
 	TypeEnvt map[string]string
@@ -23,6 +30,8 @@ type Net struct {
 	// This is only used for FENUM and CENUM (for computing predecessors and
 	// successors)
 	types map[string]*TypeDecl
+	// sorts associates a sort identifier with its declaration
+	sorts map[string]*TypeDecl
 	// ranges is used to find a suitable finite int range type given the bounds.
 	// The idea is that two ranges with the same bounds are isomorphic types.
 	ranges map[IntRange]*TypeDecl
@@ -40,15 +49,44 @@ type Net struct {
 	World map[string][]*Value
 	// vdot is the Value for the dot constant
 	vdot *Value
-}
+	// vfalse and vtrue are the Values of the bool sort
+	vfalse, vtrue *Value
+	// numbers is used to intern the values of integer sorts
+	numbers *numbers
+	// parts associates a unique Value to every partition element
+	parts map[string]*Value
+	// partitions gives, for each partition, the element containing a given
+	// value of the partitioned sort
+	partitions map[string]map[*Value]*Value
+	// nested is true if some product sort has a component of product sort
+	nested bool
+}
+
+// PTNet is the type of PNML files describing P/T nets. In this case, initial
+// markings and arc inscriptions are integers, that we interpret as multisets
+// over the dot sort.
+const PTNet = "http://www.pnml.org/version-2009/grammar/ptnet"
 
 // ----------------------------------------------------------------------
 
-// Page is the type of the page element in a PNML file.
+// Page is the type of the page element in a PNML file. A page can contain
+// other pages, as well as reference nodes pointing to places and transitions
+// declared elsewhere in the net.
 type Page struct {
-	Places []*Place      `xml:"place"`
-	Trans  []*Transition `xml:"transition"`
-	Arcs   []*Arc        `xml:"arc"`
+	ID        string        `xml:"id,attr"`
+	Places    []*Place      `xml:"place"`
+	Trans     []*Transition `xml:"transition"`
+	Arcs      []*Arc        `xml:"arc"`
+	Pages     []*Page       `xml:"page"`
+	RefPlaces []*RefNode    `xml:"referencePlace"`
+	RefTrans  []*RefNode    `xml:"referenceTransition"`
+}
+
+// RefNode is the type of referencePlace and referenceTransition elements. Ref
+// is the ID of the node it stands for, which may be another reference node.
+type RefNode struct {
+	ID  string `xml:"id,attr"`
+	Ref string `xml:"ref,attr"`
 }
 
 // Declaration is the type of a PNML net declaration. It contains declarations
@@ -74,14 +112,41 @@ type TypeDecl struct {
 	FIntRan *IntRange `xml:"finiteintrange,omitempty"`
 	Product []Type    `xml:"productsort>usersort,omitempty"`
 	Dot     *struct{} `xml:"dot,omitempty"`
+	Bool    *struct{} `xml:"bool,omitempty"`
+	Alias   *Type     `xml:"usersort,omitempty"`
+	NumSort
+}
+
+// NumSort is used to decode the built-in sorts of the PNML Integers extension.
+// These sorts are infinite, so they have no entry in the World of a net.
+type NumSort struct {
+	Integer  *struct{} `xml:"integer,omitempty"`
+	Natural  *struct{} `xml:"natural,omitempty"`
+	Positive *struct{} `xml:"positive,omitempty"`
+}
+
+// Name returns the name of the built-in sort, or the empty string if none of
+// the fields are set.
+func (s NumSort) Name() string {
+	switch {
+	case s.Integer != nil:
+		return "integer"
+	case s.Natural != nil:
+		return "natural"
+	case s.Positive != nil:
+		return "positive"
+	}
+	return ""
 }
 
 // ----------------------------------------------------------------------
 
-// PartitionDecl is the type of  PNML partition declarations.
+// PartitionDecl is the type of  PNML partition declarations. Type is a named
+// field, and not an embedded one, since encoding/xml ignores the tag of
+// embedded structs; otherwise the sort of the partition is always empty.
 type PartitionDecl struct {
-	ID         string `xml:"id,attr"`
-	Type       `xml:"usersort,omitempty"`
+	ID         string      `xml:"id,attr"`
+	Type       Type        `xml:"usersort"`
 	Partitions []Partition `xml:"partitionelement,omitempty"`
 }
 
@@ -104,10 +169,13 @@ type Fec struct {
 	ID string `xml:"id,attr"`
 }
 
-// VarDecl is the type of  PNML variable  declarations.
+// VarDecl is the type of  PNML variable  declarations. The type of a variable
+// can also be one of the built-in integer sorts or the bool sort.
 type VarDecl struct {
-	ID   string `xml:"id,attr"`
-	Type Type   `xml:"usersort"`
+	ID   string    `xml:"id,attr"`
+	Type Type      `xml:"usersort"`
+	Bool *struct{} `xml:"bool,omitempty"`
+	NumSort
 }
 
 // Type is the type of a type declaration.
@@ -123,13 +191,13 @@ type Place struct {
 	ID             string `xml:"id,attr"`
 	Type           Type   `xml:"type>structure>usersort"`
 	XML            RawXML `xml:"hlinitialMarking>structure"`
+	PTMarking      string `xml:"initialMarking>text"`
 	InitialMarking Expression
 }
 
-// RawXML is the type of PNML initial marking expressions, patterns and conditions.
-type RawXML struct {
-	InnerXML []byte `xml:",innerxml"`
-}
+// RawXML is the type of PNML initial marking expressions, patterns and
+// conditions, that we parse explicitly (see parseExpression).
+type RawXML = rawxml.RawXML
 
 // ----------------------------------------------------------------------
 
@@ -145,12 +213,22 @@ type Transition struct {
 
 // Arc is the type of edges element in a PNML net.
 type Arc struct {
+	ID      string `xml:"id,attr"`
 	Source  string `xml:"source,attr"`
 	Target  string `xml:"target,attr"`
 	XML     RawXML `xml:"hlinscription>structure"`
+	PTValue string `xml:"inscription>text"`
 	Pattern Expression
 }
 
+// describe returns a description of arc a that is used in error messages.
+func (a *Arc) describe() string {
+	if a.ID == "" {
+		return "arc from " + a.Source + " to " + a.Target
+	}
+	return "arc " + a.ID + " from " + a.Source + " to " + a.Target
+}
+
 // ----------------------------------------------------------------------
 
 // NumberConstant is used in PNML expressions.
@@ -164,6 +242,11 @@ type FIRangeConstant struct {
 	Range IntRange `xml:"finiteintrange"`
 }
 
+// BooleanConstant is used in PNML expressions.
+type BooleanConstant struct {
+	Value bool `xml:"value,attr"`
+}
+
 // Variable is used in PNML expressions.
 type Variable struct {
 	RefVariable string `xml:"refvariable,attr"`
@@ -6,6 +6,9 @@ package pnml
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/dalzilio/hue/pkg/internal/util"
 )
@@ -14,6 +17,7 @@ import (
 //
 // {0 nil} 			is a Dot
 // {i nil} 			is Constant(name) where i uniquely identifies name
+// {-i nil} 		is an integer, where -i is computed from its value (see intHead)
 // {i {j {...}}} 	is for tuples
 // we encode a range value, x, using a constant named _intx
 type Value struct {
@@ -21,27 +25,95 @@ type Value struct {
 	Tail *Value
 }
 
+// numbers is used to intern the values of integer sorts. Since these sorts are
+// infinite, values are created on demand, possibly by several workers
+// concurrently, which is why we need a lock. We also store tuples that include
+// an integer, which cannot be found in Unique.
+type numbers struct {
+	sync.Mutex
+	values map[int]*Value   // the Value of an integer
+	extra  map[Value]*Value // tuples that are not in Unique
+}
+
+// intHead returns the Head used for integer n. Natural numbers are mapped to
+// odd negative numbers and negative integers to even ones, so that the Head of
+// an integer, and thus the key of a marking, does not depend on the order in
+// which integers are interned.
+func intHead(n int) int {
+	if n >= 0 {
+		return -1 - 2*n
+	}
+	return 2 * n
+}
+
+// headInt returns the integer with (negative) Head h. This is the inverse of
+// intHead.
+func headInt(h int) int {
+	if h%2 != 0 {
+		return (-1 - h) / 2
+	}
+	return h / 2
+}
+
+// IntValue returns the (unique) Value for integer n.
+func (net *Net) IntValue(n int) *Value {
+	net.numbers.Lock()
+	defer net.numbers.Unlock()
+	if v, ok := net.numbers.values[n]; ok {
+		return v
+	}
+	v := &Value{Head: intHead(n)}
+	net.numbers.values[n] = v
+	net.numbers.extra[*v] = v
+	return v
+}
+
+// IntOf returns the integer associated with Value v. The boolean is false if v
+// is not an integer.
+func (net *Net) IntOf(v *Value) (int, bool) {
+	if v == nil || v.Head >= 0 || v.Tail != nil {
+		return 0, false
+	}
+	return headInt(v.Head), true
+}
+
+// BoolValue returns the Value for boolean b.
+func (net *Net) BoolValue(b bool) *Value {
+	if b {
+		return net.vtrue
+	}
+	return net.vfalse
+}
+
+// unique returns the unique representant of val. We first look into Unique,
+// that is never modified once the net is built, and only fall back to the
+// (locked) table of numbers for values that include an integer.
+func (net *Net) unique(val Value) *Value {
+	if pval, ok := net.Unique[val]; ok {
+		return pval
+	}
+	net.numbers.Lock()
+	defer net.numbers.Unlock()
+	if pval, ok := net.numbers.extra[val]; ok {
+		return pval
+	}
+	pval := &val
+	net.numbers.extra[val] = pval
+	return pval
+}
+
 // Atom is a pair of a multiplicity and a colored value.
 type Atom struct {
 	*Value
 	Mult int
 }
 
-// Hue is a slice of Atoms meant to represent the possible value in a colored
-// place
-type Hue []Atom
+// Hue is the multiset of values in a colored place.
+type Hue = Multiset
 
 // Marking is an association between places and Hues.
 type Marking []Hue
 
-func (pm Hue) Sum() int {
-	s := 0
-	for _, v := range pm {
-		s += v.Mult
-	}
-	return s
-}
-
 func (net *Net) PrintHue(pm Hue) string {
 	if len(pm) == 0 {
 		return "-"
@@ -53,21 +125,32 @@ func (net *Net) PrintHue(pm Hue) string {
 	return util.ZipString(res, "", "", " ")
 }
 
+// Clone returns a copy of marking m0. Hues are shared since multisets are never
+// modified in place.
 func (m0 Marking) Clone() Marking {
 	m1 := make(Marking, len(m0))
-	for k, h := range m0 {
-		m1[k] = make(Hue, len(h))
-		copy(m1[k], h)
-	}
+	copy(m1, m0)
 	return m1
 }
 
+// Key returns a string that can be used to hash marking m. Two markings have
+// the same key if and only if they are equal.
+func (m Marking) Key() string {
+	var b []byte
+	for _, h := range m {
+		b = h.appendKey(b)
+	}
+	return string(b)
+}
+
 // ----------------------------------------------------------------------
 
-// ValueIsLess reports if vi is before vj in comparaison order.
+// ValueIsLess reports if vi is before vj in comparaison order. Integers are
+// ordered by value, and constants by their Head. A tuple is before the tuples
+// that extend it, and nil is the smallest value.
 func ValueIsLess(vi, vj *Value) bool {
 	if vi == nil {
-		return vj == nil
+		return vj != nil
 	}
 	if vj == nil {
 		return false
@@ -75,22 +158,10 @@ func ValueIsLess(vi, vj *Value) bool {
 	if vi.Head == vj.Head {
 		return ValueIsLess(vi.Tail, vj.Tail)
 	}
-	return vi.Head < vj.Head
-}
-
-// AtomIsLess will sort all the Atom with multiplicity 0 first; otherwise the
-// order is based on Value.
-func AtomIsLess(ai, aj Atom) bool {
-	if ai.Mult == 0 {
-		if aj.Mult == 0 {
-			return ValueIsLess(ai.Value, aj.Value)
-		}
-		return true
-	}
-	if aj.Mult == 0 {
-		return false
+	if vi.Head < 0 && vj.Head < 0 {
+		return headInt(vi.Head) < headInt(vj.Head)
 	}
-	return ValueIsLess(ai.Value, aj.Value)
+	return vi.Head < vj.Head
 }
 
 // ----------------------------------------------------------------------
@@ -108,6 +179,9 @@ func (net *Net) PrintValue(val *Value) string {
 }
 
 func (net *Net) printHeadValue(i int) string {
+	if i < 0 {
+		return strconv.Itoa(headInt(i))
+	}
 	return net.identity[i]
 }
 
@@ -119,26 +193,116 @@ func (net *Net) printTupleValue(s string, val *Value) string {
 	return net.printTupleValue(s+", "+c, val.Tail)
 }
 
+// ParseValue returns the Value described by string s, using the same syntax
+// than PrintValue. For instance "c" for a constant and "(c1, c2)" for a tuple.
+func (net *Net) ParseValue(s string) (*Value, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "(") {
+		return net.parseHeadValue(s)
+	}
+	if !strings.HasSuffix(s, ")") {
+		return nil, fmt.Errorf("malformed tuple value %s", s)
+	}
+	elem := strings.Split(s[1:len(s)-1], ",")
+	var val *Value
+	// tuples with an integer component are not in Unique
+	numeric := false
+	for i := len(elem) - 1; i >= 0; i-- {
+		h, err := net.parseHeadValue(strings.TrimSpace(elem[i]))
+		if err != nil {
+			return nil, err
+		}
+		if numeric = numeric || h.Head < 0; numeric {
+			val = net.unique(Value{Head: h.Head, Tail: val})
+			continue
+		}
+		pval, ok := net.Unique[Value{Head: h.Head, Tail: val}]
+		if !ok {
+			return nil, fmt.Errorf("value %s does not belong to any type", s)
+		}
+		val = pval
+	}
+	return val, nil
+}
+
+func (net *Net) parseHeadValue(s string) (*Value, error) {
+	if pval, ok := net.order[s]; ok {
+		return pval, nil
+	}
+	if s == net.identity[0] {
+		return net.vdot, nil
+	}
+	if n, err := strconv.Atoi(s); err == nil {
+		return net.IntValue(n), nil
+	}
+	// we only accept the spellings used by PrintValue, and not all the ones
+	// accepted by strconv.ParseBool, like "t" or "1"
+	switch s {
+	case "true":
+		return net.vtrue, nil
+	case "false":
+		return net.vfalse, nil
+	}
+	return nil, fmt.Errorf("unknown constant %s", s)
+}
+
 // ----------------------------------------------------------------------
 
-func (net *Net) enumprod(elem []string) []*Value {
-	if len(elem) == 1 {
-		return net.World[elem[0]]
+// enumprod returns the values of the product of the sorts with values lists.
+// Components that are themselves tuples are flattened, so that a tuple value is
+// always a chain of atomic values.
+func (net *Net) enumprod(lists [][]*Value) []*Value {
+	if len(lists) == 0 {
+		return nil
+	}
+	if len(lists) == 1 {
+		return lists[0]
 	}
-	head := net.World[elem[0]]
-	tail := net.enumprod(elem[1:])
+	tail := net.enumprod(lists[1:])
 
 	var list []*Value
-	for _, a := range head {
+	for _, a := range lists[0] {
 		for _, b := range tail {
-			val := Value{Head: a.Head, Tail: b}
-			pval, ok := net.Unique[val]
-			if !ok {
-				pval = &val
-				net.Unique[val] = &val
-			}
-			list = append(list, pval)
+			list = append(list, net.concat(a, b, net.intern))
 		}
 	}
 	return list
 }
+
+// concat returns the tuple value with the components of a followed by the ones
+// of b. We use unique to find the representant of each intermediate value.
+func (net *Net) concat(a, b *Value, unique func(Value) *Value) *Value {
+	if a == nil {
+		return b
+	}
+	return unique(Value{Head: a.Head, Tail: net.concat(a.Tail, b, unique)})
+}
+
+// split returns the tuple value made of the first n components of v, and the
+// remaining components. The first result is nil if v has less than n
+// components.
+func (net *Net) split(v *Value, n int) (*Value, *Value) {
+	if v == nil || n == 0 {
+		return nil, v
+	}
+	if n == 1 {
+		return net.unique(Value{Head: v.Head}), v.Tail
+	}
+	prefix, rest := net.split(v.Tail, n-1)
+	if prefix == nil {
+		return nil, rest
+	}
+	return net.unique(Value{Head: v.Head, Tail: prefix}), rest
+}
+
+// intern returns the representant of val in Unique, adding it if needed. It
+// should only be used while building the net, since Unique is read
+// concurrently afterwards.
+func (net *Net) intern(val Value) *Value {
+	if pval, ok := net.Unique[val]; ok {
+		return pval
+	}
+	pval := &val
+	net.Unique[val] = pval
+	return pval
+}